@@ -2,69 +2,128 @@ package lsm
 
 import (
 	"encoding/json"
+	"fmt"
 	"log"
+	"qlsm/config"
 	"qlsm/kv"
+	"qlsm/ssTable"
 )
 
-// Get 获取一个元素
+// ErrCorruption 表示 SsTable 文件已损坏, Lookup 返回的错误可以通过 errors.Is 判断
+var ErrCorruption = ssTable.ErrCorruption
+
+// Get 获取一个元素, 查找出错时 (例如 SsTable 损坏) 记录日志并返回 false, 需要区分出错和不存在时使用 Lookup
 func Get[T any](key string) (ans T, ok bool) {
+	ans, ok, err := Lookup[T](key)
+	if err != nil {
+		log.Println("fail to get", key, err)
+		return ans, false
+	}
+	return ans, ok
+}
+
+// Lookup 获取一个元素, 元素不存在时返回 false, 查找出错时返回错误
+// SsTable 损坏时返回的错误满足 errors.Is(err, ErrCorruption), 通过 errors.As 可以得到包含文件名和偏移的 ssTable.CorruptionError
+func Lookup[T any](key string) (ans T, ok bool, err error) {
 	db.RLock()
 	defer db.RUnlock()
-	//log.Printf("Get %s", key)
+	value, result, err := search(key)
+	if err != nil {
+		return ans, false, fmt.Errorf("fail to search for %s: %w", key, err)
+	}
+	if result != kv.Success {
+		return ans, false, nil
+	}
+	// 分离存储的值需要从 ValueLog 中读出
+	data, err := db.ValueLog.Resolve(value.Value)
+	if err != nil {
+		return ans, false, fmt.Errorf("fail to read the value of %s: %w", key, err)
+	}
+	ans, ok = getInstance[T](data)
+	return ans, ok, nil
+}
+
+// 查找 key 最新的记录, 值可能是指向 ValueLog 的指针, 调用者需持有 db 的读锁
+func search(key string) (kv.Data, kv.SearchResult, error) {
 	// 先查内存表
 	value, result := db.MemTable.Search(key)
-	if result == kv.Success {
-		return getInstance[T](value.Value)
+	if result != kv.None {
+		return value, result, nil
 	}
-	if result == kv.Deleted {
-		return ans, false
+	// 再从新到旧查封存的 MemTable
+	for i := len(db.immutables) - 1; i >= 0; i-- {
+		value, result = db.immutables[i].table.Search(key)
+		if result != kv.None {
+			return value, result, nil
+		}
 	}
 	// 再逐层查 SsTable 文件
 	if db.TablesTree != nil {
-		value, result = db.TablesTree.Search(key)
-		if result == kv.Success {
-			return getInstance[T](value.Value)
-		}
-		if result == kv.Deleted {
-			return ans, false
-		}
+		return db.TablesTree.Search(key)
 	}
-	return ans, false
+	return kv.Data{}, kv.None, nil
 }
 
-// Set 插入元素
+// Set 插入元素, 从库上返回 false
 func Set[T any](key string, value T) bool {
-	db.Lock()
-	defer db.Unlock()
 	//log.Printf("Insert %s", key)
 	data, err := json.Marshal(value)
 	if err != nil {
 		log.Println(err)
 		return false
 	}
-	db.MemTable.Set(key, data)
-	// 写入 wal.log
-	db.Wal.Write(kv.Data{
+	return write(kv.Data{
 		Key:     key,
 		Value:   data,
 		Deleted: false,
 	})
-	return true
 }
 
-// Delete 删除元素
-func Delete(key string) {
-	db.Lock()
-	defer db.Unlock()
+// Delete 删除元素, 从库上返回 false
+func Delete(key string) bool {
 	//log.Printf("Delete %s", key)
-	db.MemTable.Delete(key)
-	db.Wal.Write(kv.Data{
+	return write(kv.Data{
 		Key:     key,
 		Value:   nil,
 		Deleted: true,
 	})
 }
 
+// 写入 wal.log 和 MemTable
+// 只持有 db 的读锁, 不同 key 的写入可以并行, 封存 MemTable 时持有写锁, 会等待正在进行的写入完成
+// 同一个 key 的写入由对应的 keyLock 串行化, 保证 MemTable 中的值与 Wal 中最后一条记录一致
+func write(value kv.Data) bool {
+	// 从库的序列号由主库分配, 本地写入会与之后复制过来的记录冲突
+	if config.GetConfig().Follower {
+		log.Println("fail to write", value.Key, ErrFollower)
+		return false
+	}
+	db.RLock()
+	defer db.RUnlock()
+	l := db.keyLock(value.Key)
+	l.Lock()
+	defer l.Unlock()
+	writeLocked(value)
+	return true
+}
+
+// 写入 wal.log 和 MemTable, 较大的值也完整地写入, 在 MemTable 落盘时才写入 ValueLog, 见 separateValues
+// 调用者需持有 db 的读锁和 key 对应的写锁
+func writeLocked(value kv.Data) {
+	db.Wal.Write(value)
+	if value.Deleted {
+		db.MemTable.Delete(value.Key)
+	} else {
+		db.MemTable.Set(value.Key, value.Value)
+	}
+}
+
+// 判断值是否需要与 key 分离, 写入 ValueLog
+func separated(value []byte) bool {
+	threshold := config.GetConfig().ValueThreshold
+	return threshold > 0 && len(value) >= threshold
+}
+
 // 将字节数组转为类型对象
 func getInstance[T any](data []byte) (T, bool) {
 	var value T
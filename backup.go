@@ -0,0 +1,43 @@
+package lsm
+
+import (
+	"os"
+	"qlsm/wal"
+	"time"
+)
+
+// Backup 将数据库当前的状态备份到 dir 中, 包括所有 SsTable、ValueLog 和尚未落盘的 Wal 段
+// 备份期间写入会被阻塞, SsTable 会尽量以硬链接的方式备份
+func Backup(dir string) error {
+	// 持有 db 的锁时后台协程无法删除已落盘的 Wal 段, SsTable 和 Wal 段的组合是一致的
+	db.Lock()
+	defer db.Unlock()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	if err := db.TablesTree.Backup(dir); err != nil {
+		return err
+	}
+	if err := db.ValueLog.Backup(dir); err != nil {
+		return err
+	}
+	return db.Wal.Backup(dir)
+}
+
+// RestoreToTime 将 backup 中的备份原地恢复到时刻 t, 回放 archiveDir 中写入时间不晚于 t 的记录
+// 恢复完成后以 backup 作为 DataDir 启动数据库, 需要保留原备份时应先复制一份, 返回回放的记录数
+// 备份之后通过 IngestFiles 导入的数据没有 Wal 记录, 不会被恢复
+func RestoreToTime(backup string, archiveDir string, t time.Time) (int, error) {
+	return wal.Restore(backup, archiveDir, func(record wal.Record) bool {
+		return record.Time > t.UnixNano()
+	})
+}
+
+// RestoreToSequence 将 backup 中的备份原地恢复到序列号 seq, 回放 archiveDir 中序列号不大于 seq 的记录
+// 恢复完成后以 backup 作为 DataDir 启动数据库, 需要保留原备份时应先复制一份, 返回回放的记录数
+// 备份之后通过 IngestFiles 导入的数据没有 Wal 记录, 不会被恢复
+func RestoreToSequence(backup string, archiveDir string, seq uint64) (int, error) {
+	return wal.Restore(backup, archiveDir, func(record wal.Record) bool {
+		return record.Seq > seq
+	})
+}
@@ -3,34 +3,117 @@ package lsm
 import (
 	"log"
 	"qlsm/config"
-	"qlsm/memTable/skiplist"
-	"runtime"
+	"qlsm/kv"
+	"qlsm/memTable"
+	"qlsm/ssTable"
 	"time"
 )
 
+// Check 定期检查 MemTable 的大小, 超过阈值时将其封存
 func Check() {
 	cfg := config.GetConfig()
 	timer := time.NewTimer(time.Duration(cfg.CheckInterval) * time.Millisecond)
 	for range timer.C {
-		db.Lock()
 		checkMemory()
-		db.TablesTree.Compaction()
-		db.Unlock()
-		runtime.GC()
 		timer.Reset(time.Duration(cfg.CheckInterval) * time.Millisecond)
 	}
 }
 
+// Flush 在后台将封存的 MemTable 写入 0 层, 然后对 SsTable 进行压实
+// 写入 SsTable 时不持有 db 的锁, 读写请求不会被阻塞
+func Flush() {
+	for range db.flushC {
+		for {
+			db.RLock()
+			if len(db.immutables) == 0 {
+				db.RUnlock()
+				break
+			}
+			imm := db.immutables[0]
+			db.RUnlock()
+
+			// 回收 ValueLog 时查到的是封存的 MemTable 中完整的值, 刚写入 ValueLog 的值会被当作无效数据,
+			// 因此直到新的 SsTable 代替封存的 MemTable 之前都不能回收
+			db.gcLock.Lock()
+			// 空的 MemTable 不写入 SsTable, 只删除它的 Wal 段
+			if imm.table.GetCount() > 0 {
+				// 新的 SsTable 与 Wal 段编号一起记录到 MANIFEST, 之后崩溃也不会再回放这些段
+				db.TablesTree.CreateTable(separateValues(imm.table), 0, imm.seqs, imm.walNumber)
+			}
+			db.Lock()
+			db.immutables = db.immutables[1:]
+			db.flushed.Broadcast()
+			db.Unlock()
+			db.gcLock.Unlock()
+			// SsTable 已落盘并加入 TablesTree, 旧的 Wal 段可以删除了
+			db.Wal.Remove(imm.walNumber)
+		}
+		db.TablesTree.Compaction()
+	}
+}
+
+// 将 t 中需要分离的值写入 ValueLog 并落盘, 返回以指针代替这些值的 Iterator, 用于将 t 写入 SsTable
+// Wal 和 MemTable 中都是完整的值, 只有 SsTable 中保存指针, 回收 ValueLog 不会影响 Wal 的回放、归档和复制
+func separateValues(t memTable.MemTable) memTable.Iterator {
+	if config.GetConfig().ValueThreshold <= 0 {
+		return t.NewIterator()
+	}
+	pointers := map[string][]byte{}
+	it := t.NewIterator()
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		if e := it.Entry(); !e.Deleted && separated(e.Value) {
+			pointers[e.Key] = db.ValueLog.Append(e.Key, e.Value)
+		}
+	}
+	// 指针指向的值必须先于 SsTable 落盘, SsTable 加入 TablesTree 后 Wal 段会被删除
+	db.ValueLog.Sync()
+	return &pointerIterator{Iterator: t.NewIterator(), pointers: pointers}
+}
+
+// pointerIterator 遍历 MemTable, 返回的元素中分离存储的值被替换为指针
+type pointerIterator struct {
+	memTable.Iterator
+	pointers map[string][]byte
+}
+
+func (it *pointerIterator) Entry() kv.Data {
+	e := it.Iterator.Entry()
+	if p, ok := it.pointers[e.Key]; ok {
+		e.Value = p
+	}
+	return e
+}
+
 func checkMemory() {
+	db.Lock()
+	defer db.Unlock()
 	cfg := config.GetConfig()
 	count := db.MemTable.GetCount()
+	// 没有数据时不封存, 否则每次检查都会写入一个空的 SsTable
+	if count == 0 {
+		return
+	}
 	size := int(db.Wal.GetSize() >> 20)
-	if count < cfg.Threshold && size < cfg.Level0Size {
+	memSize := db.MemTable.GetSize()
+	if count < cfg.Threshold && size < cfg.Level0Size && (cfg.MemTableSizeBytes <= 0 || memSize < cfg.MemTableSizeBytes) {
 		return
 	}
-	log.Printf("MemTable has %d Nodes, Wal %d MB, compressing memory\n", count, size)
-	// 将内存表存储到 SsTable 中
-	db.TablesTree.CreateTable(db.MemTable.GetValues(), 0)
-	db.MemTable.(*skiplist.SL).Reset()
-	db.Wal.Reset()
+	log.Printf("MemTable has %d Nodes, %d bytes, Wal %d MB, sealing the MemTable\n", count, memSize, size)
+	seal()
+}
+
+// 封存当前的 MemTable 并通知后台协程落盘, 调用者需持有 db 的写锁
+func seal() {
+	// 开启新的 Wal 段, 之前的段中的数据都属于被封存的 MemTable
+	number, first, last := db.Wal.Rotate()
+	db.immutables = append(db.immutables, immutable{
+		table:     db.MemTable.Swap(),
+		walNumber: number,
+		seqs:      ssTable.SeqRange{Min: first, Max: last},
+	})
+	// 通知后台协程落盘, 已有通知未处理时无需重复发送
+	select {
+	case db.flushC <- struct{}{}:
+	default:
+	}
 }
@@ -0,0 +1,109 @@
+package codec
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Codec 是数据块的压缩算法, 它的值会写入每个数据块的头部, 不能修改已有的取值
+type Codec byte
+
+const (
+	None  Codec = 0 // 不压缩
+	Flate Codec = 1 // compress/flate, 压缩率最高
+	Zlib  Codec = 2 // compress/zlib, 在 flate 的基础上增加了 adler32 校验
+	LZ    Codec = 3 // 纯 Go 实现的 LZ77 类算法, 压缩率较低但速度快
+)
+
+func (c Codec) String() string {
+	switch c {
+	case None:
+		return "none"
+	case Flate:
+		return "flate"
+	case Zlib:
+		return "zlib"
+	case LZ:
+		return "lz"
+	}
+	return fmt.Sprintf("codec(%d)", byte(c))
+}
+
+// Valid 判断 c 是否是已知的压缩算法
+func (c Codec) Valid() bool {
+	return c <= LZ
+}
+
+// Encode 压缩 src, 结果追加到 dst 后返回, c 不是已知的压缩算法时返回错误
+func (c Codec) Encode(dst []byte, src []byte) ([]byte, error) {
+	switch c {
+	case None:
+		return append(dst, src...), nil
+	case Flate:
+		buf := bytes.NewBuffer(dst)
+		w := flateWriters.Get().(*flate.Writer)
+		w.Reset(buf)
+		mustWrite(w, src)
+		flateWriters.Put(w)
+		return buf.Bytes(), nil
+	case Zlib:
+		buf := bytes.NewBuffer(dst)
+		w := zlibWriters.Get().(*zlib.Writer)
+		w.Reset(buf)
+		mustWrite(w, src)
+		zlibWriters.Put(w)
+		return buf.Bytes(), nil
+	case LZ:
+		return encodeLZ(dst, src), nil
+	}
+	return nil, fmt.Errorf("codec: unknown codec %d", byte(c))
+}
+
+// Decode 解压 src, 返回新分配的结果
+func (c Codec) Decode(src []byte) ([]byte, error) {
+	switch c {
+	case None:
+		return src, nil
+	case Flate:
+		r := flateReaders.Get().(io.ReadCloser)
+		defer flateReaders.Put(r)
+		if err := r.(flate.Resetter).Reset(bytes.NewReader(src), nil); err != nil {
+			return nil, err
+		}
+		return io.ReadAll(r)
+	case Zlib:
+		r, err := zlib.NewReader(bytes.NewReader(src))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return io.ReadAll(r)
+	case LZ:
+		return decodeLZ(src)
+	}
+	return nil, fmt.Errorf("codec: unknown codec %d", byte(c))
+}
+
+// 写入 bytes.Buffer 不会失败, 因此忽略错误
+func mustWrite(w io.WriteCloser, src []byte) {
+	_, _ = w.Write(src)
+	_ = w.Close()
+}
+
+// 复用压缩器和解压器, 避免每个数据块都分配内部的缓冲区
+var (
+	flateWriters = sync.Pool{New: func() any {
+		w, _ := flate.NewWriter(nil, flate.DefaultCompression)
+		return w
+	}}
+	zlibWriters = sync.Pool{New: func() any {
+		return zlib.NewWriter(nil)
+	}}
+	flateReaders = sync.Pool{New: func() any {
+		return flate.NewReader(bytes.NewReader(nil))
+	}}
+)
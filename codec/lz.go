@@ -0,0 +1,107 @@
+package codec
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+/*
+LZ 的格式为 uvarint 表示的原始长度, 之后是一系列的指令
+字面量: uvarint(n<<1), 之后是 n 个字节
+复制:   uvarint(n<<1 | 1), uvarint(offset), 复制已输出内容中向前 offset 处的 n 个字节, 两者可以重叠
+*/
+
+const (
+	lzMinMatch  = 4
+	lzHashBits  = 14
+	lzMaxOffset = 1 << 16
+)
+
+var errBadLZ = errors.New("codec: malformed lz data")
+
+func lzHash(u uint32) uint32 {
+	return (u * 0x1e35a7bd) >> (32 - lzHashBits)
+}
+
+// 通过哈希表查找最近出现过的 4 字节序列, 贪心地输出最长的匹配
+func encodeLZ(dst []byte, src []byte) []byte {
+	dst = binary.AppendUvarint(dst, uint64(len(src)))
+	var table [1 << lzHashBits]int32
+	literal := 0 // 尚未输出的字面量的起始位置
+	i := 0
+	for i+lzMinMatch <= len(src) {
+		cur := binary.LittleEndian.Uint32(src[i:])
+		h := lzHash(cur)
+		candidate := int(table[h]) - 1
+		table[h] = int32(i + 1)
+		if candidate < 0 || i-candidate > lzMaxOffset || binary.LittleEndian.Uint32(src[candidate:]) != cur {
+			i++
+			continue
+		}
+		n := lzMinMatch
+		for i+n < len(src) && src[candidate+n] == src[i+n] {
+			n++
+		}
+		dst = appendLiteral(dst, src[literal:i])
+		dst = binary.AppendUvarint(dst, uint64(n)<<1|1)
+		dst = binary.AppendUvarint(dst, uint64(i-candidate))
+		i += n
+		literal = i
+	}
+	return appendLiteral(dst, src[literal:])
+}
+
+func appendLiteral(dst []byte, literal []byte) []byte {
+	if len(literal) == 0 {
+		return dst
+	}
+	dst = binary.AppendUvarint(dst, uint64(len(literal))<<1)
+	return append(dst, literal...)
+}
+
+func decodeLZ(src []byte) ([]byte, error) {
+	size, n := binary.Uvarint(src)
+	if n <= 0 {
+		return nil, errBadLZ
+	}
+	src = src[n:]
+	// 原始长度可能因为数据损坏而异常大, 只预分配一个有限的容量
+	capacity := size
+	if limit := uint64(len(src)) * 16; capacity > limit {
+		capacity = limit
+	}
+	dst := make([]byte, 0, capacity)
+	for len(src) > 0 {
+		tag, n := binary.Uvarint(src)
+		if n <= 0 {
+			return nil, errBadLZ
+		}
+		src = src[n:]
+		length := tag >> 1
+		if uint64(len(dst))+length > size {
+			return nil, errBadLZ
+		}
+		if tag&1 == 0 {
+			if uint64(len(src)) < length {
+				return nil, errBadLZ
+			}
+			dst = append(dst, src[:length]...)
+			src = src[length:]
+			continue
+		}
+		offset, n := binary.Uvarint(src)
+		if n <= 0 || offset == 0 || offset > uint64(len(dst)) {
+			return nil, errBadLZ
+		}
+		src = src[n:]
+		// 复制的区域可能与输出重叠, 需要逐字节复制
+		start := len(dst) - int(offset)
+		for j := 0; j < int(length); j++ {
+			dst = append(dst, dst[start+j])
+		}
+	}
+	if uint64(len(dst)) != size {
+		return nil, errBadLZ
+	}
+	return dst, nil
+}
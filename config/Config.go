@@ -1,19 +1,89 @@
 package config
 
-import "sync"
+import (
+	"fmt"
+	"qlsm/codec"
+	"qlsm/memTable"
+	"sync"
+	"time"
+)
 
 // Config 是 lsm 的配置文件
 type Config struct {
-	DataDir       string // 数据目录
-	Level0Size    int    // 0 层所有 SsTable 文件大小总和的最大值 (MB)
-	PartSize      int    // 每层 SsTable 数量的最大值
-	Threshold     int    // MemTable 中 kv 最大数量
-	CheckInterval int    // 监控协程检查的时间间隔 (ms)
+	DataDir              string // 数据目录
+	Level0Size           int    // 0 层所有 SsTable 文件大小总和的最大值 (MB)
+	PartSize             int    // 每层 SsTable 数量的最大值
+	NumLevels            int    // SsTable 的层数, 为 0 时使用 7, 最后一层的 SsTable 压实到自身
+	LevelSizeMultiplier  int    // 相邻两层 SsTable 文件总大小上限的倍数, 为 0 时使用 4
+	DynamicLevelBytes    bool   // 为 true 时各层的大小上限由最后一层的实际大小逐层除以倍数得到, 使大部分数据位于最后一层
+	Threshold            int    // MemTable 中 kv 最大数量
+	MemTableSizeBytes    int64  // MemTable 中键、值和节点占用内存的最大值 (字节), 为 0 时不限制
+	CheckInterval        int    // 监控协程检查的时间间隔 (ms)
+	BlockSize            int    // SsTable 数据块的大小 (字节), 为 0 时使用 4KB
+	BlockRestartInterval int    // 数据块中重启点的间隔 (元素数量), 重启点之间的 key 使用前缀压缩, 为 0 时使用 16
+	BloomBitsPerKey      int    // SsTable 的 Bloom 过滤器中每个 key 占用的位数, 为 0 时使用 10, 为负数时不生成过滤器
+	IndexPartitionSize   int    // SsTable 稀疏索引分区的大小 (字节), 为 0 时不分区, 否则超过该大小的索引被拆分为按需加载的分区
+
+	BlockCacheSize int64 // 所有 SsTable 共享的块缓存的容量 (字节), 为 0 时使用 8MB, 为负数时不缓存
+	// 为 true 时 SsTable 的索引和过滤器也通过块缓存按需加载并计入容量, 否则常驻内存
+	CacheIndexAndFilterBlocks bool
+	// 在 CacheIndexAndFilterBlocks 时, 0 层 SsTable 的索引和过滤器依然常驻内存, 因为每次查找都会访问它们
+	PinL0IndexAndFilterBlocks bool
+	// 读取 SsTable 的块时不校验 CRC32C, 以一定的安全性换取速度, MetaInfo 的校验和始终会校验
+	SkipChecksums bool
+	// 在 Linux 上通过 mmap 读取 SsTable, 省去每次读取的系统调用, 适合读多写少的场景, 其他平台忽略
+	MmapReads bool
+
+	// 各层 SsTable 数据块的压缩算法, 下标为层号, 超出长度的层使用最后一个, 为空时不压缩
+	// 例如 {codec.None, codec.None, codec.LZ, codec.Flate} 让频繁压实的上层不压缩, 下层压缩率更高
+	LevelCompression []codec.Codec
+
+	// 创建 MemTable 的函数, 为 nil 时使用无锁跳表 lockfree.SL
+	// 可选 skiplist.SL (基于 arena 分配), bst.BST (AVL 树), hashtable.HT (适合单点写入, 落盘时排序)
+	MemTableFactory func() memTable.MemTable
+
+	ValueThreshold   int // 值的字节数不小于该阈值时与 key 分离, 落盘时写入 ValueLog, 为 0 时不分离
+	ValueLogFileSize int // ValueLog 单个文件的最大大小 (MB), 为 0 时使用 64MB
+
+	WalArchiveDir   string // Wal 段的归档目录, 落盘后的段会移动到这里而不是被删除, 为空时不归档
+	WalPreallocSize int    // 创建 Wal 段时预分配的大小 (MB), 为 0 时不预分配
+	WalRecycleCount int    // 最多保留多少个旧的 Wal 段文件用于复用, 配置了归档目录时不复用
+
+	// 启动回放 Wal 时的进度回调, 参数为已回放的记录数、字节数和耗时, 为 nil 时不回调
+	ReplayProgress func(records int, bytes int64, elapsed time.Duration)
+
+	// 以从库模式启动, 只能通过 ApplyRecords 写入主库的记录, Set、Delete 和 GCValueLog 会被拒绝
+	Follower bool
 }
 
+// MaxLevels 是 NumLevels 的最大值
+const MaxLevels = 32
+
 var config Config
 var once sync.Once
 
+// Validate 检查配置是否合法
+func (cfg Config) Validate() error {
+	if cfg.Threshold <= 0 {
+		return fmt.Errorf("config: Threshold must be positive, got %d", cfg.Threshold)
+	}
+	if cfg.PartSize < 1 {
+		return fmt.Errorf("config: PartSize must be positive, got %d", cfg.PartSize)
+	}
+	if cfg.NumLevels != 0 && (cfg.NumLevels < 2 || cfg.NumLevels > MaxLevels) {
+		return fmt.Errorf("config: NumLevels must be between 2 and %d, got %d", MaxLevels, cfg.NumLevels)
+	}
+	if cfg.LevelSizeMultiplier != 0 && cfg.LevelSizeMultiplier < 2 {
+		return fmt.Errorf("config: LevelSizeMultiplier must be at least 2, got %d", cfg.LevelSizeMultiplier)
+	}
+	for level, c := range cfg.LevelCompression {
+		if !c.Valid() {
+			return fmt.Errorf("config: LevelCompression[%d] is an unknown codec %d", level, byte(c))
+		}
+	}
+	return nil
+}
+
 func Init(cfg Config) {
 	once.Do(func() {
 		config = cfg
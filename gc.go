@@ -0,0 +1,88 @@
+package lsm
+
+import (
+	"bytes"
+	"log"
+	"qlsm/config"
+	"qlsm/kv"
+	"qlsm/vlog"
+)
+
+// GCValueLog 回收 ValueLog 中无效数据的比例不低于 discardRatio 的封存文件, 返回回收的文件数量
+// 文件中仍然有效的值会通过正常的写入路径重新写入 Wal 和 MemTable, 之后删除该文件, 落盘时再写入新的 ValueLog 文件
+// 被覆盖或删除的 key 留下的旧值都是无效数据, 正在写入的文件不会被回收, 从库上返回 ErrFollower
+func GCValueLog(discardRatio float64) (int, error) {
+	// 重新写入有效的值会分配新的序列号
+	if config.GetConfig().Follower {
+		return 0, ErrFollower
+	}
+	db.gcLock.Lock()
+	defer db.gcLock.Unlock()
+	collected := 0
+	for _, number := range db.ValueLog.Sealed() {
+		total, err := db.ValueLog.Size(number)
+		if err != nil {
+			return collected, err
+		}
+		live, err := liveBytes(number)
+		if err != nil {
+			return collected, err
+		}
+		if total > 0 && float64(total-live)/float64(total) < discardRatio {
+			continue
+		}
+		if err = rewriteLive(number); err != nil {
+			return collected, err
+		}
+		// 重新写入的 Wal 记录落盘后, 才能删除旧文件
+		db.Wal.Sync()
+		// 持有 db 的锁时没有正在进行的 Get, 不会读到被删除的文件
+		db.Lock()
+		db.ValueLog.Remove(number)
+		db.Unlock()
+		log.Printf("value log %d collected, %d of %d bytes live\n", number, live, total)
+		collected++
+	}
+	return collected, nil
+}
+
+// 统计 number 号文件中仍然有效的记录的字节数
+func liveBytes(number int) (int64, error) {
+	var live int64
+	err := db.ValueLog.Scan(number, func(key string, value []byte, p vlog.Pointer) error {
+		db.RLock()
+		ok, err := isLive(key, p)
+		db.RUnlock()
+		if ok {
+			live += p.Length
+		}
+		return err
+	})
+	return live, err
+}
+
+// 将 number 号文件中仍然有效的值重新写入
+func rewriteLive(number int) error {
+	return db.ValueLog.Scan(number, func(key string, value []byte, p vlog.Pointer) error {
+		db.RLock()
+		defer db.RUnlock()
+		// 持有 key 的写锁, 判断和重新写入之间不会有其他写入覆盖这个 key
+		l := db.keyLock(key)
+		l.Lock()
+		defer l.Unlock()
+		ok, err := isLive(key, p)
+		if ok {
+			writeLocked(kv.Data{Key: key, Value: value})
+		}
+		return err
+	})
+}
+
+// 判断 key 最新的记录是否指向 p, 调用者需持有 db 的读锁
+func isLive(key string, p vlog.Pointer) (bool, error) {
+	value, result, err := search(key)
+	if err != nil || result != kv.Success {
+		return false, err
+	}
+	return bytes.Equal(value.Value, p.Encode()), nil
+}
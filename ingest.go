@@ -0,0 +1,85 @@
+package lsm
+
+import (
+	"qlsm/codec"
+	"qlsm/config"
+	"qlsm/memTable"
+	"qlsm/ssTable"
+)
+
+// SstWriter 在数据库之外生成可以导入的 SsTable 文件
+type SstWriter = ssTable.SstWriter
+
+// NewSstWriter 创建一个写入 path 的 SstWriter, 数据块使用 c 压缩
+// 元素需要按 key 严格递增的顺序写入, 值需要是 JSON 编码, 与 Set 写入的值一致
+func NewSstWriter(path string, c codec.Codec) (*SstWriter, error) {
+	return ssTable.NewSstWriter(path, c)
+}
+
+// SstReader 在数据库之外读取 SsTable 文件
+type SstReader = ssTable.SstReader
+
+// OpenSstReader 打开 path 处的 SsTable 文件, 不需要启动数据库
+func OpenSstReader(path string) (*SstReader, error) {
+	return ssTable.OpenSstReader(path)
+}
+
+// IngestFiles 将 SstWriter 生成的 SsTable 文件导入数据库, 不经过 Wal 和 MemTable, 原文件保持不变
+// 文件之间的 key 范围不能重叠, 导入的数据比之前写入的数据都新, 每个文件依次分配一个序列号
+// MemTable 中有与文件重叠的数据时会先将其落盘, 导入期间写入会被阻塞
+// 分配的序列号没有对应的 Wal 记录, 正在复制的从库需要在回放到同一位置时导入同样的文件, 才能继续回放之后的记录
+// 按时间点恢复 (RestoreToTime, RestoreToSequence) 不会恢复导入的数据, 只回放导入前后的 Wal 记录
+func IngestFiles(paths []string) error {
+	files, err := ssTable.PrepareIngest(config.GetConfig().DataDir, paths)
+	if err != nil || len(files) == 0 {
+		return err
+	}
+	if err = ingest(files); err != nil {
+		return err
+	}
+	// 导入后的层可能需要压实, 恢复压实后通知后台协程检查
+	select {
+	case db.flushC <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// 暂停压实并阻塞写入, 将校验过的文件加入 TablesTree
+func ingest(files []ssTable.IngestFile) error {
+	smallest, largest := files[0].Props.SmallestKey, files[len(files)-1].Props.LargestKey
+	// 导入的文件所在的层不能在导入期间被压实后清空
+	db.TablesTree.PauseCompaction()
+	defer db.TablesTree.ResumeCompaction()
+	// MemTable 中的数据更旧, 却会先于 SsTable 被查到, 与文件重叠时需要先落盘
+	db.Lock()
+	for memOverlaps(smallest, largest) {
+		seal()
+		waitFlushed()
+	}
+	defer db.Unlock()
+	return db.TablesTree.Ingest(files, db.Wal.Reserve(len(files)))
+}
+
+// 判断 MemTable 和封存的 MemTable 中是否有 key 在 [smallest, largest] 范围内, 调用者需持有 db 的锁
+func memOverlaps(smallest string, largest string) bool {
+	tables := []memTable.MemTable{db.MemTable}
+	for _, imm := range db.immutables {
+		tables = append(tables, imm.table)
+	}
+	for _, t := range tables {
+		it := t.NewIterator()
+		it.Seek(smallest)
+		if it.Valid() && it.Entry().Key <= largest {
+			return true
+		}
+	}
+	return false
+}
+
+// 等待所有封存的 MemTable 落盘, 调用者需持有 db 的写锁, 等待期间会释放
+func waitFlushed() {
+	for len(db.immutables) > 0 {
+		db.flushed.Wait()
+	}
+}
@@ -2,11 +2,26 @@ package memTable
 
 import "qlsm/kv"
 
+// MemTable 是内存中的有序 kv 表, 删除以墓碑的形式写入
+// 实现需要支持并发调用, 除了 Reset 和 Swap 在调用期间不能有并发的读写
 type MemTable interface {
-	GetCount() int
+	GetCount() int  // 元素数量, 包括墓碑
+	GetSize() int64 // 键、值和节点占用的内存大小, 单位字节
 	Search(key string) (kv.Data, kv.SearchResult)
 	Set(key string, value []byte) (oldValue kv.Data, hasOld bool)
 	Delete(key string) (oldValue kv.Data, hasOld bool)
-	GetValues() (values []kv.Data)
-	Swap() MemTable
+	GetValues() (values []kv.Data) // 按 key 的顺序返回所有元素, 包括墓碑, Value 与 MemTable 共享, 调用者不能修改
+	NewIterator() Iterator         // 按 key 的顺序遍历所有元素, 包括墓碑, 用于落盘和范围读取
+	Reset()                        // 清空所有元素, 落盘后复用
+	Swap() MemTable                // 将所有元素转移到新的 MemTable 中并清空自身, 用于封存
+}
+
+// Iterator 按 key 的顺序遍历 MemTable, 新建的 Iterator 处于无效状态, 需要先 Seek 或 SeekToFirst
+// 遍历期间可以有并发的写入, 但不保证能看到遍历开始后写入的元素
+type Iterator interface {
+	Seek(key string) // 定位到第一个 key 不小于给定 key 的元素
+	SeekToFirst()    // 定位到第一个元素
+	Next()           // 移动到下一个元素
+	Valid() bool     // 是否指向一个元素
+	Entry() kv.Data  // 当前指向的元素, 只能在 Valid 时调用
 }
@@ -1,46 +1,64 @@
 package bst
 
 import (
-	"log"
 	"qlsm/kv"
 	"qlsm/memTable"
 	"sync"
+	"unsafe"
 )
 
+/*
+BST 是一棵 AVL 树, 插入后通过旋转保持平衡, 任意节点左右子树的高度差不超过 1
+删除只写入墓碑, 不会移除节点
+*/
+
+var nodeSize = int64(unsafe.Sizeof(Node{}))
+
 type Node struct {
-	KV    kv.Data
-	Left  *Node
-	Right *Node
+	KV     kv.Data
+	Left   *Node
+	Right  *Node
+	height int
 }
 
 type BST struct {
 	root  *Node
 	count int
+	size  int64 // 键、值和节点占用的内存大小
 	sync.RWMutex
 }
 
-// GetCount 获取树中的元素数量
+var _ memTable.MemTable = (*BST)(nil)
+
+func New() *BST {
+	return &BST{}
+}
+
+// GetCount 获取树中的元素数量 (包括墓碑)
 func (t *BST) GetCount() int {
+	t.RLock()
+	defer t.RUnlock()
 	return t.count
 }
 
+// GetSize 获取键、值和节点占用的内存大小, 单位字节
+func (t *BST) GetSize() int64 {
+	t.RLock()
+	defer t.RUnlock()
+	return t.size
+}
+
 // Search 查找 Key 的值
 func (t *BST) Search(key string) (kv.Data, kv.SearchResult) {
 	t.RLock()
 	defer t.RUnlock()
-
-	if t == nil {
-		log.Fatal("The tree is nil")
-	}
-
 	curr := t.root
 	for curr != nil {
 		if key == curr.KV.Key {
-			if !curr.KV.Deleted {
-				return curr.KV, kv.Success
-			} else {
+			if curr.KV.Deleted {
 				return kv.Data{}, kv.Deleted
 			}
+			return curr.KV, kv.Success
 		}
 		if key < curr.KV.Key {
 			curr = curr.Left
@@ -48,7 +66,6 @@ func (t *BST) Search(key string) (kv.Data, kv.SearchResult) {
 			curr = curr.Right
 		}
 	}
-
 	return kv.Data{}, kv.None
 }
 
@@ -56,120 +73,46 @@ func (t *BST) Search(key string) (kv.Data, kv.SearchResult) {
 func (t *BST) Set(key string, value []byte) (oldValue kv.Data, hasOld bool) {
 	t.Lock()
 	defer t.Unlock()
-
-	if t == nil {
-		log.Fatal("The tree is nil")
-	}
-
-	curr := t.root
-	newNode := &Node{
-		KV: kv.Data{
-			Key:   key,
-			Value: value,
-		},
-	}
-
-	if curr == nil {
-		t.root = newNode
-		t.count++
-		return kv.Data{}, false
-	}
-
-	for curr != nil {
-		// 如果已经存在键，则替换值
-		if key == curr.KV.Key {
-			oldKV := curr.KV.Copy()
-			curr.KV.Value = value
-			curr.KV.Deleted = false
-			// 返回旧值
-			if oldKV.Deleted {
-				return kv.Data{}, false
-			} else {
-				return *oldKV, true
-			}
-		}
-		if key < curr.KV.Key {
-			if curr.Left == nil {
-				curr.Left = newNode
-				t.count++
-				return kv.Data{}, false
-			}
-			curr = curr.Left
-		} else {
-			if curr.Right == nil {
-				curr.Right = newNode
-				t.count++
-				return kv.Data{}, false
-			}
-			curr = curr.Right
-		}
-	}
-	log.Fatalf("tree fail to Set value, key: %s, value: %v", key, value)
-	return kv.Data{}, false
+	return t.put(kv.Data{Key: key, Value: value, Deleted: false})
 }
 
-// Delete 删除 key 并返回旧值
+// Delete 写入 key 的墓碑并返回旧值
 func (t *BST) Delete(key string) (oldValue kv.Data, hasOld bool) {
 	t.Lock()
 	defer t.Unlock()
+	return t.put(kv.Data{Key: key, Value: nil, Deleted: true})
+}
 
-	if t == nil {
-		log.Fatal("The tree is nil")
-	}
-
-	newNode := &Node{
-		KV: kv.Data{
-			Key:     key,
-			Value:   nil,
-			Deleted: true,
-		},
-	}
-
-	curr := t.root
-	if curr == nil {
-		t.root = newNode
-		return kv.Data{}, false
-	}
-
-	for curr != nil {
-		if key == curr.KV.Key {
-			// 存在且未被删除
-			if !curr.KV.Deleted {
-				oldKV := curr.KV.Copy()
-				curr.KV.Value = nil
-				curr.KV.Deleted = true
-				// count 应该是统计当前树中存在的有效节点，但是如果删除一个不存在的key，这个count会计算错误
-				// 应该要在添加删除Node的时候count增加一下来保证count数量正确
-				t.count--
-				return *oldKV, true
-			} else { // 已被删除过
-				return kv.Data{}, false
-			}
+// 插入或更新一个节点, 调用者需持有锁
+func (t *BST) put(data kv.Data) (oldValue kv.Data, hasOld bool) {
+	var insert func(n *Node) *Node
+	insert = func(n *Node) *Node {
+		if n == nil {
+			t.count++
+			t.size += nodeSize + int64(len(data.Key)+len(data.Value))
+			return &Node{KV: data, height: 1}
 		}
-		// 往下一层查找
-		if key < curr.KV.Key {
-			// 如果不存在此 key，则插入一个删除标记
-			if curr.Left == nil {
-				curr.Left = newNode
-				t.count++
+		switch {
+		case data.Key < n.KV.Key:
+			n.Left = insert(n.Left)
+		case data.Key > n.KV.Key:
+			n.Right = insert(n.Right)
+		default:
+			// 已经存在键, 则替换值
+			if !n.KV.Deleted {
+				oldValue, hasOld = *n.KV.Copy(), true
 			}
-			// 继续对比下一层
-			curr = curr.Left
-		} else {
-			// 如果不存在此 key，则插入一个删除标记
-			if curr.Right == nil {
-				curr.Right = newNode
-				t.count++
-			}
-			// 继续对比下一层
-			curr = curr.Right
+			t.size += int64(len(data.Value) - len(n.KV.Value))
+			n.KV = data
+			return n
 		}
+		return rebalance(n)
 	}
-	log.Fatalf("The tree fail to delete key, key: %s", key)
-	return kv.Data{}, false
+	t.root = insert(t.root)
+	return oldValue, hasOld
 }
 
-// GetValues 获取树中的所有元素
+// GetValues 按 key 的顺序获取树中的所有元素
 func (t *BST) GetValues() (values []kv.Data) {
 	t.RLock()
 	defer t.RUnlock()
@@ -192,13 +135,78 @@ func (t *BST) GetValues() (values []kv.Data) {
 	return values
 }
 
+// Reset 清空树
+func (t *BST) Reset() {
+	t.Lock()
+	defer t.Unlock()
+	t.root = nil
+	t.count = 0
+	t.size = 0
+}
+
 func (t *BST) Swap() memTable.MemTable {
 	t.Lock()
 	defer t.Unlock()
 	newTree := &BST{}
 	newTree.root = t.root
 	newTree.count = t.count
+	newTree.size = t.size
 	t.root = nil
 	t.count = 0
+	t.size = 0
 	return newTree
 }
+
+func height(n *Node) int {
+	if n == nil {
+		return 0
+	}
+	return n.height
+}
+
+func updateHeight(n *Node) {
+	n.height = max(height(n.Left), height(n.Right)) + 1
+}
+
+// 通过旋转使 n 重新平衡, 返回子树新的根节点
+func rebalance(n *Node) *Node {
+	updateHeight(n)
+	switch balance := height(n.Left) - height(n.Right); {
+	case balance > 1:
+		if height(n.Left.Left) < height(n.Left.Right) {
+			n.Left = rotateLeft(n.Left)
+		}
+		return rotateRight(n)
+	case balance < -1:
+		if height(n.Right.Right) < height(n.Right.Left) {
+			n.Right = rotateRight(n.Right)
+		}
+		return rotateLeft(n)
+	}
+	return n
+}
+
+func rotateLeft(n *Node) *Node {
+	r := n.Right
+	n.Right = r.Left
+	r.Left = n
+	updateHeight(n)
+	updateHeight(r)
+	return r
+}
+
+func rotateRight(n *Node) *Node {
+	l := n.Left
+	n.Left = l.Right
+	l.Right = n
+	updateHeight(n)
+	updateHeight(l)
+	return l
+}
+
+func max(i, j int) int {
+	if i > j {
+		return i
+	}
+	return j
+}
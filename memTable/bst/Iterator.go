@@ -0,0 +1,64 @@
+package bst
+
+import (
+	"qlsm/kv"
+	"qlsm/memTable"
+)
+
+// Iterator 按 key 的顺序遍历树
+// 旋转会改变树的结构, 因此不保存遍历路径, 每次移动都从根节点重新查找下一个 key
+type Iterator struct {
+	t     *BST
+	valid bool
+	entry kv.Data
+}
+
+// NewIterator 创建一个遍历树的 Iterator
+func (t *BST) NewIterator() memTable.Iterator {
+	return &Iterator{t: t}
+}
+
+// Seek 定位到第一个 key 不小于给定 key 的元素
+func (it *Iterator) Seek(key string) {
+	it.seek(key, true)
+}
+
+// SeekToFirst 定位到第一个元素
+func (it *Iterator) SeekToFirst() {
+	it.seek("", true)
+}
+
+// Next 移动到下一个元素
+func (it *Iterator) Next() {
+	it.seek(it.entry.Key, false)
+}
+
+// Valid 是否指向一个元素
+func (it *Iterator) Valid() bool {
+	return it.valid
+}
+
+// Entry 当前指向的元素
+func (it *Iterator) Entry() kv.Data {
+	return it.entry
+}
+
+// 定位到第一个 key 大于 (inclusive 时不小于) 给定 key 的元素
+func (it *Iterator) seek(key string, inclusive bool) {
+	it.t.RLock()
+	defer it.t.RUnlock()
+	var found *Node
+	curr := it.t.root
+	for curr != nil {
+		if curr.KV.Key > key || (inclusive && curr.KV.Key == key) {
+			found = curr
+			curr = curr.Left
+		} else {
+			curr = curr.Right
+		}
+	}
+	it.valid = found != nil
+	if found != nil {
+		it.entry = found.KV
+	}
+}
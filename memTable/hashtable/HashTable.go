@@ -0,0 +1,138 @@
+package hashtable
+
+import (
+	"hash/maphash"
+	"qlsm/kv"
+	"qlsm/memTable"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+)
+
+/*
+HT 是按 key 分片的哈希表, 适合以单点写入和查询为主的负载
+写入和查询都是 O(1), 不同分片之间互不阻塞, 但不维护顺序, GetValues 时才对所有 key 排序
+*/
+
+const shardCount = 64
+
+var entrySize = int64(unsafe.Sizeof(kv.Data{}))
+
+type shard struct {
+	data map[string]*kv.Data
+	sync.RWMutex
+}
+
+type HT struct {
+	shards [shardCount]*shard
+	seed   maphash.Seed
+	count  atomic.Int64
+	size   atomic.Int64 // 键、值和元素占用的内存大小
+}
+
+var _ memTable.MemTable = (*HT)(nil)
+
+func New() *HT {
+	t := &HT{seed: maphash.MakeSeed()}
+	t.init()
+	return t
+}
+
+func (t *HT) init() {
+	for i := range t.shards {
+		t.shards[i] = &shard{data: map[string]*kv.Data{}}
+	}
+	t.count.Store(0)
+	t.size.Store(0)
+}
+
+// 获取 key 所在的分片
+func (t *HT) shard(key string) *shard {
+	return t.shards[maphash.String(t.seed, key)%shardCount]
+}
+
+// GetCount 获取哈希表中的元素数量 (包括墓碑)
+func (t *HT) GetCount() int {
+	return int(t.count.Load())
+}
+
+// GetSize 获取键、值和元素占用的内存大小, 单位字节
+func (t *HT) GetSize() int64 {
+	return t.size.Load()
+}
+
+// Search 查找 Key 的值
+func (t *HT) Search(key string) (kv.Data, kv.SearchResult) {
+	s := t.shard(key)
+	s.RLock()
+	defer s.RUnlock()
+	data, ok := s.data[key]
+	if !ok {
+		return kv.Data{}, kv.None
+	}
+	if data.Deleted {
+		return kv.Data{}, kv.Deleted
+	}
+	return *data, kv.Success
+}
+
+// Set 设置 Key 的值并返回旧值
+func (t *HT) Set(key string, value []byte) (oldValue kv.Data, hasOld bool) {
+	return t.put(kv.Data{Key: key, Value: value, Deleted: false})
+}
+
+// Delete 写入 key 的墓碑并返回旧值
+func (t *HT) Delete(key string) (oldValue kv.Data, hasOld bool) {
+	return t.put(kv.Data{Key: key, Value: nil, Deleted: true})
+}
+
+// 插入或更新一个元素
+func (t *HT) put(data kv.Data) (oldValue kv.Data, hasOld bool) {
+	s := t.shard(data.Key)
+	s.Lock()
+	defer s.Unlock()
+	old, ok := s.data[data.Key]
+	if !ok {
+		s.data[data.Key] = &data
+		t.count.Add(1)
+		t.size.Add(entrySize + int64(len(data.Key)+len(data.Value)))
+		return kv.Data{}, false
+	}
+	t.size.Add(int64(len(data.Value) - len(old.Value)))
+	s.data[data.Key] = &data
+	if old.Deleted {
+		return kv.Data{}, false
+	}
+	return *old, true
+}
+
+// GetValues 按 key 的顺序获取哈希表中的所有元素, 需要对所有元素排序
+func (t *HT) GetValues() (values []kv.Data) {
+	values = make([]kv.Data, 0, t.count.Load())
+	for _, s := range t.shards {
+		s.RLock()
+		for _, data := range s.data {
+			values = append(values, *data)
+		}
+		s.RUnlock()
+	}
+	sort.Slice(values, func(i, j int) bool {
+		return values[i].Key < values[j].Key
+	})
+	return values
+}
+
+// Reset 清空哈希表, 调用期间不能有并发的读写
+func (t *HT) Reset() {
+	t.init()
+}
+
+// Swap 将哈希表的内容转移到一个新的哈希表中并重置自身, 调用期间不能有并发的读写
+func (t *HT) Swap() memTable.MemTable {
+	tmp := &HT{seed: t.seed, shards: t.shards}
+	tmp.count.Store(t.count.Load())
+	tmp.size.Store(t.size.Load())
+	t.init()
+	return tmp
+}
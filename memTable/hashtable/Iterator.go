@@ -0,0 +1,45 @@
+package hashtable
+
+import (
+	"qlsm/kv"
+	"qlsm/memTable"
+	"sort"
+)
+
+// Iterator 遍历哈希表在创建时的排好序的快照
+type Iterator struct {
+	values []kv.Data
+	index  int
+}
+
+// NewIterator 创建一个遍历哈希表的 Iterator, 需要复制并排序所有元素
+func (t *HT) NewIterator() memTable.Iterator {
+	return &Iterator{values: t.GetValues(), index: -1}
+}
+
+// Seek 定位到第一个 key 不小于给定 key 的元素
+func (it *Iterator) Seek(key string) {
+	it.index = sort.Search(len(it.values), func(i int) bool {
+		return it.values[i].Key >= key
+	})
+}
+
+// SeekToFirst 定位到第一个元素
+func (it *Iterator) SeekToFirst() {
+	it.index = 0
+}
+
+// Next 移动到下一个元素
+func (it *Iterator) Next() {
+	it.index++
+}
+
+// Valid 是否指向一个元素
+func (it *Iterator) Valid() bool {
+	return it.index >= 0 && it.index < len(it.values)
+}
+
+// Entry 当前指向的元素
+func (it *Iterator) Entry() kv.Data {
+	return it.values[it.index]
+}
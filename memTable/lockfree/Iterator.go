@@ -0,0 +1,45 @@
+package lockfree
+
+import (
+	"qlsm/kv"
+	"qlsm/memTable"
+)
+
+// Iterator 按 key 的顺序无锁地遍历跳表
+type Iterator struct {
+	sl   *SL
+	node *node
+}
+
+// NewIterator 创建一个遍历跳表的 Iterator
+func (sl *SL) NewIterator() memTable.Iterator {
+	return &Iterator{sl: sl}
+}
+
+// Seek 定位到第一个 key 不小于给定 key 的元素
+func (it *Iterator) Seek(key string) {
+	var preds, succs [maxLevel]*node
+	it.sl.findSplice(key, &preds, &succs)
+	it.node = succs[0]
+}
+
+// SeekToFirst 定位到第一个元素
+func (it *Iterator) SeekToFirst() {
+	it.node = it.sl.head.forward[0].Load()
+}
+
+// Next 移动到下一个元素
+func (it *Iterator) Next() {
+	it.node = it.node.forward[0].Load()
+}
+
+// Valid 是否指向一个元素
+func (it *Iterator) Valid() bool {
+	return it.node != nil
+}
+
+// Entry 当前指向的元素
+func (it *Iterator) Entry() kv.Data {
+	e := it.node.entry.Load()
+	return kv.Data{Key: it.node.key, Value: e.value, Deleted: e.deleted}
+}
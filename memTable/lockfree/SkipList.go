@@ -0,0 +1,242 @@
+package lockfree
+
+import (
+	"math/rand"
+	"qlsm/kv"
+	"qlsm/memTable"
+	"sync/atomic"
+	"unsafe"
+)
+
+/*
+SL 是一个无锁的并发跳表, 多个协程可以同时读写
+节点只插入不删除, 删除通过写入墓碑实现, 因此插入只需要用 CAS 逐层修改前向指针,
+修改已有节点的值则原子地替换它指向的 entry
+*/
+
+const maxLevel = 32
+const pFactor = 0.25
+
+var (
+	nodeSize    = int64(unsafe.Sizeof(node{}))
+	entrySize   = int64(unsafe.Sizeof(entry{}))
+	pointerSize = int64(unsafe.Sizeof(atomic.Pointer[node]{}))
+)
+
+type node struct {
+	key     string
+	entry   atomic.Pointer[entry]
+	forward []atomic.Pointer[node]
+}
+
+// entry 是节点的值, 写入后不再修改
+type entry struct {
+	value   []byte
+	deleted bool
+}
+
+type SL struct {
+	head  *node
+	level atomic.Int32
+	count atomic.Int64
+	size  atomic.Int64 // 键、值和节点占用的内存大小
+
+	nodes    *slab[node]
+	entries  *slab[entry]
+	pointers *slab[atomic.Pointer[node]]
+	bytes    *slab[byte]
+}
+
+var _ memTable.MemTable = (*SL)(nil)
+
+func New() *SL {
+	sl := &SL{}
+	sl.init()
+	return sl
+}
+
+func (sl *SL) init() {
+	sl.head = &node{forward: make([]atomic.Pointer[node], maxLevel)}
+	sl.level.Store(1)
+	sl.count.Store(0)
+	sl.size.Store(0)
+	sl.nodes = &slab[node]{chunkSize: 1024}
+	sl.entries = &slab[entry]{chunkSize: 1024}
+	sl.pointers = &slab[atomic.Pointer[node]]{chunkSize: 4096}
+	sl.bytes = &slab[byte]{chunkSize: 64 << 10}
+}
+
+func (sl *SL) randomLevel() int {
+	lv := 1
+	for lv < maxLevel && rand.Float64() < pFactor {
+		lv++
+	}
+	return lv
+}
+
+// GetCount 获取跳表中的元素数量
+func (sl *SL) GetCount() int {
+	return int(sl.count.Load())
+}
+
+// GetSize 获取键、值和节点占用的内存大小, 单位字节
+func (sl *SL) GetSize() int64 {
+	return sl.size.Load()
+}
+
+// Search 查找 Key 的值
+func (sl *SL) Search(key string) (kv.Data, kv.SearchResult) {
+	curr := sl.head
+	for i := int(sl.level.Load()) - 1; i >= 0; i-- {
+		for next := curr.forward[i].Load(); next != nil && next.key < key; next = curr.forward[i].Load() {
+			curr = next
+		}
+	}
+	curr = curr.forward[0].Load()
+	if curr != nil && curr.key == key {
+		e := curr.entry.Load()
+		if e.deleted {
+			return kv.Data{}, kv.Deleted
+		}
+		return kv.Data{Key: curr.key, Value: e.value}, kv.Success
+	}
+	return kv.Data{}, kv.None
+}
+
+// Set 设置 Key 的值并返回旧值
+func (sl *SL) Set(key string, value []byte) (oldValue kv.Data, hasOld bool) {
+	return sl.put(key, value, false)
+}
+
+// Delete 写入 key 的墓碑并返回旧值
+func (sl *SL) Delete(key string) (oldValue kv.Data, hasOld bool) {
+	return sl.put(key, nil, true)
+}
+
+// 插入或更新 key 对应的节点
+func (sl *SL) put(key string, value []byte, deleted bool) (oldValue kv.Data, hasOld bool) {
+	e := sl.newEntry(value, deleted)
+	var preds, succs [maxLevel]*node
+	if found := sl.findSplice(key, &preds, &succs); found != nil {
+		return sl.replace(found, e)
+	}
+
+	lv := sl.randomLevel()
+	for level := sl.level.Load(); int(level) < lv; level = sl.level.Load() {
+		if sl.level.CompareAndSwap(level, int32(lv)) {
+			break
+		}
+	}
+	n := sl.newNode(key, e, lv)
+	for i := 0; i < lv; i++ {
+		for {
+			// 层数提升后 preds 可能还没有计算
+			if preds[i] == nil {
+				sl.findSpliceForLevel(key, i, sl.head, &preds, &succs)
+			}
+			n.forward[i].Store(succs[i])
+			if preds[i].forward[i].CompareAndSwap(succs[i], n) {
+				break
+			}
+			// 其他协程在 preds[i] 之后插入了节点, 重新查找这一层的位置
+			sl.findSpliceForLevel(key, i, preds[i], &preds, &succs)
+			// 第 0 层插入前, 其他协程可能已经插入了相同的 key
+			if i == 0 && succs[0] != nil && succs[0].key == key {
+				return sl.replace(succs[0], e)
+			}
+		}
+	}
+	// 节点链接到第 0 层后才计入大小, 与相同 key 竞争失败时丢弃的节点不计入
+	sl.size.Add(nodeSize + int64(len(key)) + int64(lv)*pointerSize)
+	sl.count.Add(1)
+	return kv.Data{}, false
+}
+
+// 原子地替换节点的值, 返回旧值
+func (sl *SL) replace(n *node, e *entry) (oldValue kv.Data, hasOld bool) {
+	old := n.entry.Swap(e)
+	if old.deleted {
+		return kv.Data{}, false
+	}
+	return kv.Data{Key: n.key, Value: old.value}, true
+}
+
+// 从上到下查找每一层中 key 的前驱和后继, 如果 key 已存在则返回对应的节点
+func (sl *SL) findSplice(key string, preds, succs *[maxLevel]*node) *node {
+	curr := sl.head
+	for i := int(sl.level.Load()) - 1; i >= 0; i-- {
+		sl.findSpliceForLevel(key, i, curr, preds, succs)
+		curr = preds[i]
+	}
+	if succs[0] != nil && succs[0].key == key {
+		return succs[0]
+	}
+	return nil
+}
+
+// 从 start 开始查找第 level 层中 key 的前驱和后继
+func (sl *SL) findSpliceForLevel(key string, level int, start *node, preds, succs *[maxLevel]*node) {
+	curr := start
+	next := curr.forward[level].Load()
+	for next != nil && next.key < key {
+		curr = next
+		next = curr.forward[level].Load()
+	}
+	preds[level] = curr
+	succs[level] = next
+}
+
+// GetValues 获取跳表中的所有元素
+func (sl *SL) GetValues() (values []kv.Data) {
+	for curr := sl.head.forward[0].Load(); curr != nil; curr = curr.forward[0].Load() {
+		e := curr.entry.Load()
+		values = append(values, kv.Data{Key: curr.key, Value: e.value, Deleted: e.deleted})
+	}
+	return values
+}
+
+// Reset 清空跳表, 调用期间不能有并发的读写
+func (sl *SL) Reset() {
+	sl.init()
+}
+
+// Swap 将跳表的内容转移到一个新的跳表中并重置自身, 调用期间不能有并发的读写
+func (sl *SL) Swap() memTable.MemTable {
+	tmpSL := &SL{
+		head:     sl.head,
+		nodes:    sl.nodes,
+		entries:  sl.entries,
+		pointers: sl.pointers,
+		bytes:    sl.bytes,
+	}
+	tmpSL.level.Store(sl.level.Load())
+	tmpSL.count.Store(sl.count.Load())
+	tmpSL.size.Store(sl.size.Load())
+	sl.init()
+	return tmpSL
+}
+
+// 分配一个节点, key 会被复制到 slab 中, 节点的大小在插入成功后才计入
+func (sl *SL) newNode(key string, e *entry, level int) *node {
+	n := &sl.nodes.alloc(1)[0]
+	if len(key) > 0 {
+		bs := sl.bytes.alloc(len(key))
+		copy(bs, key)
+		n.key = unsafe.String(&bs[0], len(bs))
+	}
+	n.entry.Store(e)
+	n.forward = sl.pointers.alloc(level)
+	return n
+}
+
+// 分配一个 entry, value 会被复制到 slab 中
+func (sl *SL) newEntry(value []byte, deleted bool) *entry {
+	e := &sl.entries.alloc(1)[0]
+	e.deleted = deleted
+	if value != nil {
+		e.value = sl.bytes.alloc(len(value))
+		copy(e.value, value)
+	}
+	sl.size.Add(entrySize + int64(len(value)))
+	return e
+}
@@ -0,0 +1,220 @@
+package lockfree
+
+import (
+	"fmt"
+	"qlsm/kv"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestSetSearchDelete(t *testing.T) {
+	sl := New()
+	if _, hasOld := sl.Set("b", []byte("1")); hasOld {
+		t.Fatal("a new key should not have an old value")
+	}
+	if old, hasOld := sl.Set("b", []byte("2")); !hasOld || string(old.Value) != "1" {
+		t.Fatalf("Set returned %q %v, want the old value 1", old.Value, hasOld)
+	}
+	if v, result := sl.Search("b"); result != kv.Success || string(v.Value) != "2" {
+		t.Fatalf("Search(b) = %q %v", v.Value, result)
+	}
+	if _, result := sl.Search("a"); result != kv.None {
+		t.Fatalf("Search(a) = %v, want None", result)
+	}
+
+	// 删除已有的 key 返回旧值, 删除不存在的 key 写入墓碑
+	if old, hasOld := sl.Delete("b"); !hasOld || string(old.Value) != "2" {
+		t.Fatalf("Delete returned %q %v, want the old value 2", old.Value, hasOld)
+	}
+	if _, hasOld := sl.Delete("c"); hasOld {
+		t.Fatal("deleting a missing key should not have an old value")
+	}
+	for _, key := range []string{"b", "c"} {
+		if _, result := sl.Search(key); result != kv.Deleted {
+			t.Fatalf("Search(%s) = %v, want Deleted", key, result)
+		}
+	}
+	if _, hasOld := sl.Set("c", []byte("3")); hasOld {
+		t.Fatal("a tombstone should not be returned as the old value")
+	}
+	if sl.GetCount() != 2 {
+		t.Fatalf("GetCount() = %d, want 2", sl.GetCount())
+	}
+
+	values := sl.GetValues()
+	if len(values) != 2 || values[0].Key != "b" || !values[0].Deleted || values[1].Key != "c" || string(values[1].Value) != "3" {
+		t.Fatalf("GetValues() = %v", values)
+	}
+}
+
+func TestIteratorSeek(t *testing.T) {
+	sl := New()
+	for i := 0; i < 100; i += 2 {
+		sl.Set(fmt.Sprintf("k%03d", i), []byte(strconv.Itoa(i)))
+	}
+	sl.Delete("k010")
+	it := sl.NewIterator()
+	if it.Valid() {
+		t.Fatal("a new iterator should not be valid")
+	}
+	it.Seek("k009")
+	if !it.Valid() || it.Entry().Key != "k010" || !it.Entry().Deleted {
+		t.Fatalf("Seek(k009) should stop at the tombstone of k010, got %v", it.Entry())
+	}
+	it.Next()
+	if !it.Valid() || it.Entry().Key != "k012" {
+		t.Fatalf("Next() = %v, want k012", it.Entry())
+	}
+	it.Seek("k099")
+	if it.Valid() {
+		t.Fatalf("Seek after the last key should be invalid, got %v", it.Entry())
+	}
+	n := 0
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		n++
+	}
+	if n != 50 {
+		t.Fatalf("iterated %d entries, want 50", n)
+	}
+}
+
+// 多个协程同时写入相同和不同的 key, 同时有协程查找和遍历
+func TestConcurrentReadWrite(t *testing.T) {
+	const writers, keys, rounds = 8, 500, 20
+	sl := New()
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	errs := make(chan error, 4)
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func(r int) {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if r%2 == 0 {
+					// 遍历结果始终有序且没有重复的 key
+					prev := ""
+					it := sl.NewIterator()
+					for it.SeekToFirst(); it.Valid(); it.Next() {
+						key := it.Entry().Key
+						if key <= prev {
+							errs <- fmt.Errorf("the iterator returned %q after %q", key, prev)
+							return
+						}
+						prev = key
+					}
+				} else {
+					for i := 0; i < keys; i += 7 {
+						key := fmt.Sprintf("k%04d", i)
+						if v, result := sl.Search(key); result == kv.Success && v.Key != key {
+							errs <- fmt.Errorf("Search(%s) returned the key %s", key, v.Key)
+							return
+						}
+					}
+				}
+			}
+		}(r)
+	}
+
+	var writersWg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		writersWg.Add(1)
+		go func(w int) {
+			defer writersWg.Done()
+			for r := 0; r < rounds; r++ {
+				for i := 0; i < keys; i++ {
+					key := fmt.Sprintf("k%04d", i)
+					if i%5 == w%5 {
+						sl.Delete(key)
+					} else {
+						sl.Set(key, []byte(strconv.Itoa(w)))
+					}
+				}
+			}
+		}(w)
+	}
+	writersWg.Wait()
+	close(stop)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	if sl.GetCount() != keys {
+		t.Fatalf("GetCount() = %d, want %d", sl.GetCount(), keys)
+	}
+	values := sl.GetValues()
+	if len(values) != keys {
+		t.Fatalf("GetValues() returned %d entries, want %d", len(values), keys)
+	}
+	for i, v := range values {
+		if want := fmt.Sprintf("k%04d", i); v.Key != want {
+			t.Fatalf("values[%d].Key = %s, want %s", i, v.Key, want)
+		}
+		if !v.Deleted {
+			if w, err := strconv.Atoi(string(v.Value)); err != nil || w < 0 || w >= writers {
+				t.Fatalf("the value of %s is %q, which no writer wrote", v.Key, v.Value)
+			}
+		}
+	}
+}
+
+// 相同 key 的并发插入只有一个节点被链接, 其余协程改为替换值, 丢弃的节点不计入大小
+func TestSizeCountsLinkedNodes(t *testing.T) {
+	const goroutines, keys, tables = 8, 16, 200
+	for n := 0; n < tables; n++ {
+		sl := New()
+		start := make(chan struct{})
+		var wg sync.WaitGroup
+		for g := 0; g < goroutines; g++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				<-start
+				for i := 0; i < keys; i++ {
+					sl.Set(strconv.Itoa(i), []byte("value"))
+				}
+			}()
+		}
+		close(start)
+		wg.Wait()
+
+		// 每次写入都会分配一个 entry, 节点只计算链接到跳表中的
+		want := int64(goroutines*keys) * (entrySize + int64(len("value")))
+		for n := sl.head.forward[0].Load(); n != nil; n = n.forward[0].Load() {
+			want += nodeSize + int64(len(n.key)) + int64(len(n.forward))*pointerSize
+		}
+		if got := sl.GetSize(); got != want {
+			t.Fatalf("GetSize() = %d, want %d", got, want)
+		}
+		if sl.GetCount() != keys {
+			t.Fatalf("GetCount() = %d, want %d", sl.GetCount(), keys)
+		}
+	}
+}
+
+func TestSwap(t *testing.T) {
+	sl := New()
+	sl.Set("a", []byte("1"))
+	sl.Delete("b")
+	size := sl.GetSize()
+	old := sl.Swap()
+	if sl.GetCount() != 0 || sl.GetSize() != 0 {
+		t.Fatalf("the swapped skiplist should be empty, got %d entries and %d bytes", sl.GetCount(), sl.GetSize())
+	}
+	if old.GetCount() != 2 || old.GetSize() != size {
+		t.Fatalf("the sealed skiplist has %d entries and %d bytes, want 2 and %d", old.GetCount(), old.GetSize(), size)
+	}
+	if v, result := old.Search("a"); result != kv.Success || string(v.Value) != "1" {
+		t.Fatalf("Search(a) on the sealed skiplist = %q %v", v.Value, result)
+	}
+	if _, result := sl.Search("a"); result != kv.None {
+		t.Fatalf("Search(a) on the new skiplist = %v, want None", result)
+	}
+}
@@ -0,0 +1,41 @@
+package lockfree
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// slab 以大块内存为单位并发地分配 T, 分配时只在换块时加锁
+// slab 中的内存只随整个跳表一起释放
+type slab[T any] struct {
+	chunkSize int
+	chunk     atomic.Pointer[chunk[T]]
+	mu        sync.Mutex
+}
+
+type chunk[T any] struct {
+	items []T
+	used  atomic.Int64
+}
+
+// 分配 n 个 T, 较大的分配单独申请, 避免浪费当前块的剩余空间
+func (s *slab[T]) alloc(n int) []T {
+	if n > s.chunkSize/4 {
+		return make([]T, n)
+	}
+	for {
+		c := s.chunk.Load()
+		if c != nil {
+			end := c.used.Add(int64(n))
+			if end <= int64(len(c.items)) {
+				return c.items[end-int64(n) : end : end]
+			}
+		}
+		// 当前块已用完, 只有一个协程负责换块
+		s.mu.Lock()
+		if s.chunk.Load() == c {
+			s.chunk.Store(&chunk[T]{items: make([]T, s.chunkSize)})
+		}
+		s.mu.Unlock()
+	}
+}
@@ -0,0 +1,63 @@
+package skiplist
+
+import (
+	"qlsm/kv"
+	"qlsm/memTable"
+)
+
+// Iterator 按 key 的顺序遍历跳表, 每次移动时持有读锁
+type Iterator struct {
+	sl    *SL
+	node  *Node
+	entry kv.Data
+}
+
+// NewIterator 创建一个遍历跳表的 Iterator
+func (sl *SL) NewIterator() memTable.Iterator {
+	return &Iterator{sl: sl}
+}
+
+// Seek 定位到第一个 key 不小于给定 key 的元素
+func (it *Iterator) Seek(key string) {
+	it.sl.RLock()
+	defer it.sl.RUnlock()
+	curr := it.sl.head
+	for i := it.sl.level - 1; i >= 0; i-- {
+		for curr.forward[i] != nil && curr.forward[i].KV.Key < key {
+			curr = curr.forward[i]
+		}
+	}
+	it.set(curr.forward[0])
+}
+
+// SeekToFirst 定位到第一个元素
+func (it *Iterator) SeekToFirst() {
+	it.sl.RLock()
+	defer it.sl.RUnlock()
+	it.set(it.sl.head.forward[0])
+}
+
+// Next 移动到下一个元素
+func (it *Iterator) Next() {
+	it.sl.RLock()
+	defer it.sl.RUnlock()
+	it.set(it.node.forward[0])
+}
+
+// Valid 是否指向一个元素
+func (it *Iterator) Valid() bool {
+	return it.node != nil
+}
+
+// Entry 当前指向的元素
+func (it *Iterator) Entry() kv.Data {
+	return it.entry
+}
+
+// 指向 node, 并在持有读锁时复制它的值, 调用者需持有读锁
+func (it *Iterator) set(node *Node) {
+	it.node = node
+	if node != nil {
+		it.entry = node.KV
+	}
+}
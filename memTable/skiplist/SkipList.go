@@ -20,6 +20,7 @@ type SL struct {
 	head  *Node
 	level int
 	count int
+	arena arena // 节点和键值所占的内存都从 arena 中分配
 	sync.RWMutex
 }
 
@@ -42,11 +43,20 @@ func (sl *SL) randomLevel() int {
 	return lv
 }
 
-// GetCount 获取树中的元素数量
+// GetCount 获取跳表中的元素数量
 func (sl *SL) GetCount() int {
+	sl.RLock()
+	defer sl.RUnlock()
 	return sl.count
 }
 
+// GetSize 获取键、值和节点占用的内存大小, 单位字节
+func (sl *SL) GetSize() int64 {
+	sl.RLock()
+	defer sl.RUnlock()
+	return sl.arena.size
+}
+
 // Search 查找 Key 的值
 func (sl *SL) Search(key string) (kv.Data, kv.SearchResult) {
 	sl.RLock()
@@ -87,21 +97,18 @@ func (sl *SL) Set(key string, value []byte) (oldValue kv.Data, hasOld bool) {
 	if curr != nil && curr.KV.Key == key {
 		if curr.KV.Deleted {
 			curr.KV.Deleted = false
-			curr.KV.Value = value
+			curr.KV.Value = sl.arena.copyValue(value)
 			return kv.Data{}, false
 		} else {
 			oldValue = *curr.KV.Copy()
-			curr.KV.Value = value
+			curr.KV.Value = sl.arena.copyValue(value)
 			return oldValue, true
 		}
 	}
 	sl.count++
 	lv := sl.randomLevel()
 	sl.level = max(sl.level, lv)
-	newNode := &Node{
-		KV:      kv.Data{Key: key, Value: value, Deleted: false},
-		forward: make([]*Node, lv),
-	}
+	newNode := sl.arena.newNode(key, value, false, lv)
 	for i, node := range update[:lv] {
 		newNode.forward[i] = node.forward[i]
 		node.forward[i] = newNode
@@ -139,10 +146,7 @@ func (sl *SL) Delete(key string) (oldValue kv.Data, hasOld bool) {
 	sl.count++
 	lv := sl.randomLevel()
 	sl.level = max(sl.level, lv)
-	newNode := &Node{
-		KV:      kv.Data{Key: key, Value: nil, Deleted: true},
-		forward: make([]*Node, lv),
-	}
+	newNode := sl.arena.newNode(key, nil, true, lv)
 	for i, node := range update[:lv] {
 		newNode.forward[i] = node.forward[i]
 		node.forward[i] = newNode
@@ -150,7 +154,7 @@ func (sl *SL) Delete(key string) (oldValue kv.Data, hasOld bool) {
 	return kv.Data{}, false
 }
 
-// GetValues 获取树中的所有元素
+// GetValues 按 key 的顺序获取跳表中的所有元素, 元素的 Value 指向 arena 中的内存, 调用者不能修改
 func (sl *SL) GetValues() (values []kv.Data) {
 	sl.RLock()
 	defer sl.RUnlock()
@@ -167,6 +171,7 @@ func (sl *SL) Reset() {
 	defer sl.Unlock()
 	sl.count = 0
 	sl.level = 0
+	sl.arena = arena{}
 	sl.head = &Node{
 		KV:      kv.Data{Key: "", Value: nil, Deleted: true},
 		forward: make([]*Node, maxLevel),
@@ -181,10 +186,12 @@ func (sl *SL) Swap() memTable.MemTable {
 	tmpSL.count = sl.count
 	tmpSL.level = sl.level
 	tmpSL.head = sl.head
+	tmpSL.arena = sl.arena
 
 	// 将 sl 初始化
 	sl.count = 0
 	sl.level = 0
+	sl.arena = arena{}
 	sl.head = &Node{
 		KV:      kv.Data{Key: "", Value: nil, Deleted: true},
 		forward: make([]*Node, maxLevel),
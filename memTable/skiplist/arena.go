@@ -0,0 +1,83 @@
+package skiplist
+
+import "unsafe"
+
+const (
+	nodeChunk    = 1024     // 每次分配的节点数量
+	pointerChunk = 4096     // 每次分配的前向指针数量
+	byteChunk    = 64 << 10 // 每次分配的键值字节数
+)
+
+var (
+	nodeSize    = int64(unsafe.Sizeof(Node{}))
+	pointerSize = int64(unsafe.Sizeof((*Node)(nil)))
+)
+
+// arena 以大块内存为单位为跳表分配节点、前向指针和键值字节, 减少小对象的数量和 GC 压力
+// arena 中的内存只随整个跳表一起释放, 覆盖写入的旧值所占的空间不会被回收
+type arena struct {
+	nodes    []Node  // 当前节点块中未使用的部分
+	pointers []*Node // 当前指针块中未使用的部分
+	bytes    []byte  // 当前字节块中未使用的部分
+	size     int64   // 已分配出去的字节数
+}
+
+// 分配一个有 level 层前向指针的节点, 键和值会被复制到 arena 中
+func (a *arena) newNode(key string, value []byte, deleted bool, level int) *Node {
+	if len(a.nodes) == 0 {
+		a.nodes = make([]Node, nodeChunk)
+	}
+	node := &a.nodes[0]
+	a.nodes = a.nodes[1:]
+	node.KV.Key = a.copyKey(key)
+	node.KV.Value = a.copyValue(value)
+	node.KV.Deleted = deleted
+	node.forward = a.newForward(level)
+	a.size += nodeSize
+	return node
+}
+
+// 分配 level 个前向指针
+func (a *arena) newForward(level int) []*Node {
+	if len(a.pointers) < level {
+		a.pointers = make([]*Node, pointerChunk)
+	}
+	forward := a.pointers[:level:level]
+	a.pointers = a.pointers[level:]
+	a.size += int64(level) * pointerSize
+	return forward
+}
+
+// 将 key 复制到 arena 中
+func (a *arena) copyKey(key string) string {
+	if len(key) == 0 {
+		return ""
+	}
+	bs := a.alloc(len(key))
+	copy(bs, key)
+	return unsafe.String(&bs[0], len(bs))
+}
+
+// 将 value 复制到 arena 中, nil 表示没有值
+func (a *arena) copyValue(value []byte) []byte {
+	if value == nil {
+		return nil
+	}
+	bs := a.alloc(len(value))
+	copy(bs, value)
+	return bs
+}
+
+// 分配 n 个字节, 较大的分配单独申请, 避免浪费当前块的剩余空间
+func (a *arena) alloc(n int) []byte {
+	a.size += int64(n)
+	if n > byteChunk/4 {
+		return make([]byte, n)
+	}
+	if len(a.bytes) < n {
+		a.bytes = make([]byte, byteChunk)
+	}
+	bs := a.bytes[:n:n]
+	a.bytes = a.bytes[n:]
+	return bs
+}
@@ -1,12 +1,14 @@
 package lsm
 
 import (
+	"hash/fnv"
 	"log"
 	"os"
 	"qlsm/config"
 	"qlsm/memTable"
-	"qlsm/memTable/skiplist"
+	"qlsm/memTable/lockfree"
 	"qlsm/ssTable"
+	"qlsm/vlog"
 	"qlsm/wal"
 	"sync"
 )
@@ -15,9 +17,32 @@ type DB struct {
 	MemTable   memTable.MemTable
 	TablesTree *ssTable.TablesTree
 	Wal        *wal.Wal
+	ValueLog   *vlog.ValueLog           // 与 key 分离存储的较大的值
+	immutables []immutable              // 已封存、等待落盘的 MemTable, 从旧到新排列
+	flushC     chan struct{}            // 通知后台协程落盘
+	flushed    *sync.Cond               // 封存的 MemTable 落盘后广播, 与 db 的写锁关联
+	keyLocks   [keyLockCount]sync.Mutex // 按 key 的哈希分片的写锁
+	gcLock     sync.Mutex               // 同一时刻只进行一次 ValueLog 的回收, 封存的 MemTable 落盘期间不能回收
 	sync.RWMutex
 }
 
+// keyLockCount 是写锁的分片数量
+const keyLockCount = 256
+
+// 获取 key 对应的写锁
+func (db *DB) keyLock(key string) *sync.Mutex {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+	return &db.keyLocks[h.Sum32()%keyLockCount]
+}
+
+// immutable 是一个只读的 MemTable
+type immutable struct {
+	table     memTable.MemTable
+	walNumber int              // 编号小于 walNumber 的 Wal 段中的数据都属于该 MemTable
+	seqs      ssTable.SeqRange // 该 MemTable 中记录的序列号范围
+}
+
 var db *DB
 
 // Start 启动数据库
@@ -27,6 +52,14 @@ func Start(cfg config.Config) {
 	}
 
 	log.Println("load the configuration...")
+	if err := cfg.Validate(); err != nil {
+		log.Panicln("invalid configuration:", err)
+	}
+	if cfg.MemTableFactory == nil {
+		cfg.MemTableFactory = func() memTable.MemTable {
+			return lockfree.New()
+		}
+	}
 	config.Init(cfg)
 
 	log.Println("initialize DB...")
@@ -34,6 +67,11 @@ func Start(cfg config.Config) {
 
 	log.Println("start checking in the background...")
 	go Check()
+
+	log.Println("start flushing in the background...")
+	go Flush()
+	// 启动时检查一次已有 SsTable 是否需要压实
+	db.flushC <- struct{}{}
 }
 
 // 初始化 DB, 从磁盘文件中还原 SsTable, Wal, MemTable
@@ -45,14 +83,25 @@ func initDatabase(dir string) {
 		}
 	}
 	db = &DB{
-		MemTable:   skiplist.New(),
+		MemTable:   config.GetConfig().MemTableFactory(),
 		Wal:        &wal.Wal{},
 		TablesTree: &ssTable.TablesTree{},
+		flushC:     make(chan struct{}, 1),
 	}
-
-	log.Println("load Wal, recover MemTable...")
-	db.MemTable = db.Wal.Load(dir)
+	db.flushed = sync.NewCond(db)
 
 	log.Println("load DB...")
 	db.TablesTree.Init(dir)
+
+	log.Println("load ValueLog...")
+	// 即使没有配置 ValueThreshold 也需要打开, 之前写入的指针仍然指向它
+	db.ValueLog = vlog.Open(dir, config.GetConfig().ValueLogFileSize)
+
+	log.Println("load Wal, recover MemTable...")
+	// 回放出的数据过多时直接写入 0 层, 避免启动时占用过多内存
+	// MANIFEST 中记录的 Wal 段之前的数据都已在 SsTable 中, 不再回放
+	// 落盘时记录仍需回放的第一个段, 之后崩溃只会重新回放这个段, 重复写入其中已落盘的部分
+	db.MemTable = db.Wal.Load(dir, db.TablesTree.WalNumber(), db.TablesTree.LastSeq(), func(mt memTable.MemTable, first uint64, last uint64, number int) {
+		db.TablesTree.CreateTable(separateValues(mt), 0, ssTable.SeqRange{Min: first, Max: last}, number)
+	})
 }
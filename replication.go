@@ -0,0 +1,49 @@
+package lsm
+
+import (
+	"errors"
+	"fmt"
+	"qlsm/wal"
+)
+
+// ErrFollower 表示数据库以从库模式启动, 拒绝本地写入
+var ErrFollower = errors.New("lsm: the database is a follower, local writes are rejected")
+
+// WALReader 从 Wal 中按序列号顺序读取已写入的记录, 用于向从库或外部消费者传输日志
+type WALReader = wal.Reader
+
+// NewWALReader 创建一个从序列号 seq 开始读取的 WALReader, 读到最新的记录后会阻塞等待新的记录
+// seq 之后的记录所在的段已被删除时返回 wal.ErrSequenceUnavailable
+func NewWALReader(seq uint64) (*WALReader, error) {
+	return db.Wal.NewReader(seq)
+}
+
+// LastSequence 获取最后一条写入的记录的序列号
+func LastSequence() uint64 {
+	return db.Wal.LastSeq()
+}
+
+// ApplyRecords 在从库上按原有的序列号回放主库的记录, 写入从库的 Wal 和 MemTable
+// 序列号不大于从库最后一条记录的会被跳过, 因此重复回放是幂等的
+// 从库需要以 config.Config.Follower 启动, 拒绝会分配序列号的本地写入, 否则序列号会与主库冲突
+func ApplyRecords(records []wal.Record) error {
+	db.Lock()
+	defer db.Unlock()
+	for _, record := range records {
+		last := db.Wal.LastSeq()
+		if record.Seq <= last {
+			continue
+		}
+		if record.Seq != last+1 {
+			return fmt.Errorf("missing records between sequence %d and %d", last, record.Seq)
+		}
+		// 主库的记录中是完整的值, 落盘时按从库自己的配置分离存储
+		db.Wal.WriteRecord(record)
+		if record.Deleted {
+			db.MemTable.Delete(record.Key)
+		} else {
+			db.MemTable.Set(record.Key, record.Value)
+		}
+	}
+	return nil
+}
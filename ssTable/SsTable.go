@@ -3,14 +3,26 @@ package ssTable
 import (
 	"encoding/binary"
 	"encoding/json"
+	"fmt"
+	"hash/crc32"
 	"log"
 	"os"
+	"qlsm/config"
 	"qlsm/kv"
 	"sync"
+	"sync/atomic"
 )
 
 /*
-索引从数据区开始
+文件格式如下, 索引从数据区开始
+版本 0 的 SparseIndex 是包含每个 key 的 JSON map[string]Position, 数据区是每个 kv.Data 的 JSON
+版本 1 的数据区是按 key 排好序的数据块, SparseIndex 只为每个数据块保存最大的 key 和位置, 格式见 block.go
+版本 2 在 SparseIndex 之后增加了 Bloom 过滤器块, 它的位置和长度保存在 MetaInfo 之前的 16 个字节中, 格式见 filter.go
+版本 3 的数据块以压缩算法开头, 可以按层配置不同的压缩算法
+版本 4 在每个块之后增加了 CRC32C, MetaInfo 带有校验和 magic, 格式见 checksum.go
+版本 5 在过滤器块之后增加了属性块, 记录 key 的范围、数量和序列号范围等, 格式见 properties.go
+版本 6 的数据块对 key 使用前缀压缩, 并带有用于块内二分查找的重启点
+版本 7 的 SparseIndex 可以分区, 此时它是指向各个分区的顶层索引, 分区位于数据区之后, 格式见 index.go
 0 ─────────────────────────────────────────────────────────►
 ◄──────────────────────────
           dataLen           ◄────────────────
@@ -26,10 +38,31 @@ type SsTable struct {
 	f           *os.File            //文件句柄
 	filepath    string              // SsTable 文件路径
 	metaInfo    MetaInfo            // SsTable 元数据
-	sparseIndex map[string]Position // 文件的稀疏索引列表
-	sync.Mutex
+	sparseIndex map[string]Position // 版本 0 文件的索引, 包含每个 key
+	index       []blockHandle       // 版本 1 及之后的文件的稀疏索引, 每个数据块 (或分区) 一个条目, cacheMeta 时为 nil
+	filter      []byte              // 版本 2 及之后的文件的 Bloom 过滤器, cacheMeta 时为 nil
+	props       *Properties         // 版本 5 及之后的文件的属性, 常驻内存
+	number      uint64              // 进程内唯一的编号, 用作块缓存的 key
+	cache       *blockCache         // 共享的块缓存, 为 nil 时不缓存
+	cacheMeta   bool                // 索引和过滤器通过块缓存按需加载, 而不是常驻内存
+	size        int64               // 文件大小
+	mmap        []byte              // MmapReads 时映射到内存中的文件内容
+	refs        atomic.Int32        // 引用它的 version 数量, 归零时关闭并删除文件
+	// 读取时持有读锁, 关闭文件时持有写锁
+	sync.RWMutex
 }
 
+const (
+	versionJSON       = 0 // 每个 key 一个索引条目的 JSON 格式
+	versionBlock      = 1 // 按数据块组织的格式
+	versionFilter     = 2 // 增加了 Bloom 过滤器的格式
+	versionCodec      = 3 // 数据块带有压缩算法头部的格式
+	versionChecksum   = 4 // 每个块和 MetaInfo 都带有 CRC32C 的格式
+	versionProperties = 5 // 增加了属性块的格式
+	versionPrefix     = 6 // 数据块中的 key 使用前缀压缩, 带有重启点的格式
+	versionPartition  = 7 // 稀疏索引可以分区的格式
+)
+
 // MetaInfo 是 SsTable 的元数据, 存储在文件的末尾
 type MetaInfo struct {
 	version    int64 // 版本号
@@ -37,6 +70,14 @@ type MetaInfo struct {
 	dataLen    int64 // 数据区长度
 	indexStart int64 // 稀疏索引区起始索引
 	indexLen   int64 // 稀疏索引区长度
+	// 以下字段从版本 2 开始存在
+	filterStart int64 // 过滤器块起始索引
+	filterLen   int64 // 过滤器块长度
+	// 以下字段从版本 5 开始存在
+	propsStart int64 // 属性块起始索引
+	propsLen   int64 // 属性块长度
+	// 以下字段从版本 7 开始存在
+	partitions int64 // 稀疏索引的分区数量, 为 0 时不分区
 }
 
 // Position 存储在 SparseIndex 中, 表示 KV 的起始位置和长度
@@ -46,82 +87,399 @@ type Position struct {
 	Deleted bool  //删除标志
 }
 
-// Load 将 db 文件 加载成 SsTable, sparseIndex 常驻内存
+// Load 将 db 文件 加载成 SsTable, 索引常驻内存
 func (t *SsTable) Load(filepath string) {
 	t.filepath = filepath
-	t.sparseIndex = map[string]Position{}
+	if err := t.load(); err != nil {
+		log.Panic("fail to load ", t.filepath, ": ", err.Error())
+	}
+}
 
+// 打开文件, 读取元数据和属性, 并加载常驻内存的稀疏索引区和过滤器块
+func (t *SsTable) load() error {
 	// 加载文件句柄
-	f, err := os.OpenFile(t.filepath, os.O_RDONLY, 0666)
-	if err != nil {
-		log.Panic("fail to open file", t.filepath, ":", err.Error())
+	if err := t.open(); err != nil {
+		return err
 	}
-	t.f = f
 
 	// 加载元数据
-	if _, err = f.Seek(-8*5, 2); err != nil {
-		log.Panic("fail to seek metadata for version:", err.Error())
+	if err := t.loadMetaInfo(); err != nil {
+		return err
 	}
-	_ = binary.Read(f, binary.LittleEndian, &t.metaInfo.version)
 
-	if _, err = f.Seek(-8*4, 2); err != nil {
-		log.Panic("fail to seek metadata for dataStart:", err.Error())
+	if err := t.loadProperties(); err != nil {
+		return err
 	}
-	_ = binary.Read(f, binary.LittleEndian, &t.metaInfo.dataStart)
 
-	if _, err = f.Seek(-8*3, 2); err != nil {
-		log.Panic("fail to seek metadata for dataLen:", err.Error())
+	// 加载稀疏索引区和过滤器块
+	switch t.metaInfo.version {
+	case versionJSON:
+		bs, err := t.readAt(t.metaInfo.indexStart, t.metaInfo.indexLen)
+		if err != nil {
+			return err
+		}
+		t.sparseIndex = map[string]Position{}
+		if err = json.Unmarshal(bs, &t.sparseIndex); err != nil {
+			return t.corruption(t.metaInfo.indexStart, "fail to unmarshal for sparseIndex: "+err.Error())
+		}
+	case versionBlock, versionFilter, versionCodec, versionChecksum, versionProperties, versionPrefix, versionPartition:
+		if t.cacheMeta {
+			break
+		}
+		var err error
+		if t.index, err = t.loadIndex(); err != nil {
+			return err
+		}
+		if t.filter, err = t.loadFilter(); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown version %d", t.metaInfo.version)
 	}
-	_ = binary.Read(f, binary.LittleEndian, &t.metaInfo.dataLen)
+	return nil
+}
 
-	if _, err = f.Seek(-8*2, 2); err != nil {
-		log.Panic("fail to seek metadata for indexStart:", err.Error())
+// 读取文件末尾的元数据, 版本 4 之前的 MetaInfo 没有校验和, 版本号位于文件末尾往前 40 字节处
+func (t *SsTable) loadMetaInfo() error {
+	if t.size < 8*5 {
+		return t.corruption(0, "the file is too short")
+	}
+	tail, err := t.readAt(t.size-8, 8)
+	if err != nil {
+		return err
+	}
+	if binary.LittleEndian.Uint64(tail) == tableMagic {
+		// 先读出版本号, 再按版本读取完整的 MetaInfo
+		if t.size < footerTail {
+			return t.corruption(0, "the file is too short")
+		}
+		bs, err := t.readAt(t.size-footerTail, 8)
+		if err != nil {
+			return err
+		}
+		version := int64(binary.LittleEndian.Uint64(bs))
+		size := footerSize(version)
+		if version < versionChecksum || version > versionPartition {
+			return t.corruption(t.size-footerTail, fmt.Sprintf("unknown version %d", version))
+		}
+		if t.size < size {
+			return t.corruption(0, "the file is too short")
+		}
+		footer, err := t.readAt(t.size-size, size)
+		if err != nil {
+			return err
+		}
+		if t.metaInfo, err = decodeFooter(footer); err != nil {
+			return t.corruption(t.size-size, err.Error())
+		}
+		return nil
 	}
-	_ = binary.Read(f, binary.LittleEndian, &t.metaInfo.indexStart)
 
-	if _, err = f.Seek(-8*1, 2); err != nil {
-		log.Panic("fail to seek metadata for indexLen:", err.Error())
+	footer, err := t.readAt(t.size-8*5, 8*5)
+	if err != nil {
+		return err
+	}
+	t.metaInfo.version = int64(binary.LittleEndian.Uint64(footer[0:]))
+	t.metaInfo.dataStart = int64(binary.LittleEndian.Uint64(footer[8:]))
+	t.metaInfo.dataLen = int64(binary.LittleEndian.Uint64(footer[16:]))
+	t.metaInfo.indexStart = int64(binary.LittleEndian.Uint64(footer[24:]))
+	t.metaInfo.indexLen = int64(binary.LittleEndian.Uint64(footer[32:]))
+	if t.metaInfo.version >= versionChecksum {
+		return t.corruption(t.size-8*5, "missing the magic number")
 	}
-	_ = binary.Read(f, binary.LittleEndian, &t.metaInfo.indexLen)
+	if t.metaInfo.version >= versionFilter {
+		if footer, err = t.readAt(t.size-8*7, 8*2); err != nil {
+			return err
+		}
+		t.metaInfo.filterStart = int64(binary.LittleEndian.Uint64(footer[0:]))
+		t.metaInfo.filterLen = int64(binary.LittleEndian.Uint64(footer[8:]))
+	}
+	return nil
+}
 
-	// 加载稀疏索引区
-	bs := make([]byte, t.metaInfo.indexLen)
-	if _, err = f.Seek(t.metaInfo.indexStart, 0); err != nil {
-		log.Panic("fail to seek sparseIndex:", err.Error())
+// 从文件中读取并解码稀疏索引区
+func (t *SsTable) loadIndex() ([]blockHandle, error) {
+	bs, err := t.readBlockAt(t.metaInfo.indexStart, t.metaInfo.indexLen)
+	if err != nil {
+		return nil, err
 	}
-	if _, err = f.Read(bs); err != nil {
-		log.Panic("fail to read sparseIndex:", err.Error())
+	index, err := decodeIndex(bs)
+	if err != nil {
+		return nil, t.corruption(t.metaInfo.indexStart, err.Error())
 	}
-	if err = json.Unmarshal(bs, &t.sparseIndex); err != nil {
-		log.Panic("fail to unmarshal for sparseIndex:", err.Error())
+	return index, nil
+}
+
+// 从文件中读取过滤器块, 没有过滤器时返回 nil
+func (t *SsTable) loadFilter() ([]byte, error) {
+	if !t.hasFilter() {
+		return nil, nil
 	}
-	_, _ = f.Seek(0, 0)
+	return t.readBlockAt(t.metaInfo.filterStart, t.metaInfo.filterLen)
 }
 
-// Search 先通过 sparseIndex 找到 Position, 再从数据区加载
-func (t *SsTable) Search(key string) (value kv.Data, result kv.SearchResult) {
-	t.Lock()
-	defer t.Unlock()
+// 获取稀疏索引, cacheMeta 时通过块缓存加载
+func (t *SsTable) getIndex() ([]blockHandle, error) {
+	if !t.cacheMeta {
+		return t.index, nil
+	}
+	key := cacheKey{number: t.number, offset: t.metaInfo.indexStart}
+	if v, ok := t.cache.get(key); ok {
+		return v.([]blockHandle), nil
+	}
+	index, err := t.loadIndex()
+	if err != nil {
+		return nil, err
+	}
+	t.cache.put(key, index, t.metaInfo.indexLen+int64(len(index))*blockHandleSize)
+	return index, nil
+}
+
+// 获取过滤器, cacheMeta 时通过块缓存加载
+func (t *SsTable) getFilter() ([]byte, error) {
+	if !t.cacheMeta {
+		return t.filter, nil
+	}
+	key := cacheKey{number: t.number, offset: t.metaInfo.filterStart}
+	if v, ok := t.cache.get(key); ok {
+		return v.([]byte), nil
+	}
+	filter, err := t.loadFilter()
+	if err != nil {
+		return nil, err
+	}
+	t.cache.put(key, filter, int64(len(filter)))
+	return filter, nil
+}
+
+// 是否有 Bloom 过滤器
+func (t *SsTable) hasFilter() bool {
+	return t.metaInfo.version >= versionFilter && t.metaInfo.filterLen > 0
+}
+
+// 通过属性中 key 的范围判断 key 是否可能存在, 返回 false 时 key 一定不存在
+func (t *SsTable) inRange(key string) bool {
+	return t.props == nil || t.props.containsKey(key)
+}
+
+// 通过 Bloom 过滤器判断 key 是否可能存在, 返回 false 时 key 一定不存在
+func (t *SsTable) mayContain(key string) bool {
+	if !t.hasFilter() {
+		return true
+	}
+	filter, err := t.getFilter()
+	if err != nil {
+		log.Println("fail to load the filter of", t.filepath, err)
+		return true
+	}
+	return filterMayContain(filter, key)
+}
+
+// Search 在 SsTable 中查找 key, 文件损坏时返回 ErrCorruption
+func (t *SsTable) Search(key string) (kv.Data, kv.SearchResult, error) {
+	if t.metaInfo.version == versionJSON {
+		return t.searchJSON(key)
+	}
+	iter, err := t.newIndexIter()
+	if err != nil {
+		return kv.Data{}, kv.None, err
+	}
+	// 只有第一个最大 key 不小于 key 的数据块可能包含 key
+	if !iter.seek(key) {
+		return kv.Data{}, kv.None, iter.err
+	}
+	h := iter.handle()
+	block, err := t.readBlock(h, true)
+	if err != nil {
+		return kv.Data{}, kv.None, err
+	}
+	value, ok, err := searchBlock(block, key, t.metaInfo.version >= versionPrefix)
+	if err != nil {
+		return kv.Data{}, kv.None, t.corruption(h.offset, err.Error())
+	}
+	if !ok {
+		return kv.Data{}, kv.None, nil
+	}
+	if value.Deleted {
+		return kv.Data{}, kv.Deleted, nil
+	}
+	return value, kv.Success, nil
+}
+
+// 在版本 0 的文件中先通过 sparseIndex 找到 Position, 再从数据区加载
+func (t *SsTable) searchJSON(key string) (kv.Data, kv.SearchResult, error) {
 	position, exist := t.sparseIndex[key]
 	if !exist {
-		return kv.Data{}, kv.None
+		return kv.Data{}, kv.None, nil
 	}
 	if position.Deleted {
-		return kv.Data{}, kv.Deleted
+		return kv.Data{}, kv.Deleted, nil
 	}
 	// 从磁盘文件中查找
-	bs := make([]byte, position.Len)
-	if _, err := t.f.Seek(position.Start, 0); err != nil {
-		log.Println("fail to seek for data:", key, err)
-		return kv.Data{}, kv.None
+	bs, err := t.readAt(position.Start, position.Len)
+	if err != nil {
+		return kv.Data{}, kv.None, err
+	}
+	var value kv.Data
+	if err = json.Unmarshal(bs, &value); err != nil {
+		return kv.Data{}, kv.None, t.corruption(position.Start, "fail to unmarshal for data: "+err.Error())
+	}
+	return value, kv.Success, nil
+}
+
+// 读取一个数据块, 返回解压后的内容, 先从块缓存中查找, fill 为 true 时将读到的块加入块缓存
+// 返回的数据块可能被其他读者共享, 不能修改
+func (t *SsTable) readBlock(h blockHandle, fill bool) ([]byte, error) {
+	key := cacheKey{number: t.number, offset: h.offset}
+	if v, ok := t.cache.get(key); ok {
+		return v.([]byte), nil
+	}
+	block, err := t.readBlockAt(h.offset, h.length)
+	if err != nil {
+		return nil, err
 	}
-	if _, err := t.f.Read(bs); err != nil {
-		log.Println("fail to read for data:", err)
-		return kv.Data{}, kv.None
+	if t.metaInfo.version >= versionCodec {
+		if block, err = uncompressBlock(block); err != nil {
+			return nil, t.corruption(h.offset, "fail to uncompress the block: "+err.Error())
+		}
+	}
+	if fill {
+		t.cache.put(key, block, int64(len(block)))
+	}
+	return block, nil
+}
+
+// 读取 offset 处长度为 length 的块, 版本 4 及之后的文件会校验块之后的 CRC32C, 除非配置了 SkipChecksums
+func (t *SsTable) readBlockAt(offset int64, length int64) ([]byte, error) {
+	return t.readBlockVerified(offset, length, !config.GetConfig().SkipChecksums)
+}
+
+// 读取 offset 处长度为 length 的块, verify 为 true 时校验版本 4 及之后的文件中块之后的 CRC32C
+func (t *SsTable) readBlockVerified(offset int64, length int64, verify bool) ([]byte, error) {
+	if t.metaInfo.version < versionChecksum {
+		return t.readAt(offset, length)
+	}
+	bs, err := t.readAt(offset, length+checksumLen)
+	if err != nil {
+		return nil, err
+	}
+	block := bs[:length]
+	if verify {
+		if crc32.Checksum(block, crcTable) != binary.LittleEndian.Uint32(bs[length:]) {
+			return nil, t.corruption(offset, "block checksum mismatch")
+		}
+	}
+	return block, nil
+}
+
+// 返回描述 offset 处损坏的错误
+func (t *SsTable) corruption(offset int64, reason string) error {
+	return &CorruptionError{File: t.filepath, Offset: offset, Reason: reason}
+}
+
+// 从文件的 offset 处读取 length 个字节, 读不满时返回错误
+// 使用 pread 或者 mmap, 不改变文件的读写位置, 因此同一个 SsTable 可以被并发读取
+func (t *SsTable) readAt(offset int64, length int64) ([]byte, error) {
+	t.RLock()
+	defer t.RUnlock()
+	if t.f == nil {
+		return nil, os.ErrClosed
+	}
+	// 位置和长度来自文件中的元数据, 超出文件范围说明文件已损坏
+	if offset < 0 || length < 0 || offset+length > t.size {
+		return nil, t.corruption(offset, fmt.Sprintf("read %d bytes beyond the end of the file", length))
+	}
+	bs := make([]byte, length)
+	// 映射的内存在关闭后会失效, 复制出来才能被缓存或者返回给调用者
+	if t.mmap != nil {
+		copy(bs, t.mmap[offset:offset+length])
+		return bs, nil
+	}
+	if _, err := t.f.ReadAt(bs, offset); err != nil {
+		return nil, err
+	}
+	return bs, nil
+}
+
+// 以只读方式打开文件, 配置了 MmapReads 时将整个文件映射到内存中
+func (t *SsTable) open() error {
+	f, err := os.OpenFile(t.filepath, os.O_RDONLY, 0666)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+	t.f, t.size = f, info.Size()
+	if config.GetConfig().MmapReads && t.size > 0 {
+		if t.mmap, err = mmapFile(f, t.size); err != nil {
+			log.Println("fail to mmap", t.filepath, "fall back to pread:", err)
+		}
+	}
+	return nil
+}
+
+// 关闭文件, 等待正在进行的读取结束
+func (t *SsTable) close() error {
+	t.Lock()
+	defer t.Unlock()
+	if t.mmap != nil {
+		if err := munmapFile(t.mmap); err != nil {
+			return err
+		}
+		t.mmap = nil
+	}
+	err := t.f.Close()
+	t.f = nil
+	return err
+}
+
+// 按顺序遍历 SsTable 中的所有元素 (版本 0 的文件不保证顺序), 包括墓碑
+func (t *SsTable) scan(fn func(kv.Data)) error {
+	if t.metaInfo.version == versionJSON {
+		data, err := t.readAt(t.metaInfo.dataStart, t.metaInfo.dataLen)
+		if err != nil {
+			return err
+		}
+		for k, p := range t.sparseIndex {
+			if p.Deleted {
+				fn(kv.Data{Key: k, Deleted: true})
+				continue
+			}
+			if p.Start < 0 || p.Len < 0 || p.Start+p.Len > int64(len(data)) {
+				return t.corruption(p.Start, "the position is beyond the data area")
+			}
+			var value kv.Data
+			if err := json.Unmarshal(data[p.Start:(p.Start+p.Len)], &value); err != nil {
+				return t.corruption(p.Start, "fail to unmarshal for data: "+err.Error())
+			}
+			fn(value)
+		}
+		return nil
+	}
+	iter, err := t.newIndexIter()
+	if err != nil {
+		return err
 	}
-	if err := json.Unmarshal(bs, &value); err != nil {
-		log.Println("fail to unmarshal for data:", err)
-		return kv.Data{}, kv.None
+	// 遍历只会读取每个数据块一次, 不加入块缓存, 避免淘汰热点数据
+	for iter.next() {
+		h := iter.handle()
+		block, err := t.readBlock(h, false)
+		if err != nil {
+			return err
+		}
+		it, err := newBlockIter(block, t.metaInfo.version >= versionPrefix)
+		if err != nil {
+			return t.corruption(h.offset, err.Error())
+		}
+		for it.next() {
+			fn(it.entry)
+		}
+		if it.err != nil {
+			return t.corruption(h.offset, it.err.Error())
+		}
 	}
-	return value, kv.Success
+	return nil
 }
@@ -0,0 +1,284 @@
+package ssTable
+
+import (
+	"qlsm/kv"
+	"sort"
+)
+
+// SstReader 在数据库之外只读地打开任意版本的 db 文件, 不需要初始化配置或数据目录
+// 与 key 分离存储的值以 ValueLog 指针的形式返回, 可以通过 vlog.DecodePointer 识别
+type SstReader struct {
+	t *SsTable
+}
+
+// OpenSstReader 打开 path 并加载元数据、属性、稀疏索引和过滤器
+func OpenSstReader(path string) (*SstReader, error) {
+	t := &SsTable{filepath: path}
+	if err := t.load(); err != nil {
+		_ = t.close()
+		return nil, err
+	}
+	return &SstReader{t: t}, nil
+}
+
+// Version 获取文件的格式版本
+func (r *SstReader) Version() int64 {
+	return r.t.metaInfo.version
+}
+
+// Properties 获取文件的属性, 版本 5 之前的文件没有属性块, 返回 false
+func (r *SstReader) Properties() (Properties, bool) {
+	return r.t.Properties()
+}
+
+// Get 查找 key, key 被删除时返回 kv.Deleted, 文件损坏时返回 ErrCorruption
+func (r *SstReader) Get(key string) (kv.Data, kv.SearchResult, error) {
+	if !r.t.inRange(key) || !r.t.mayContain(key) {
+		return kv.Data{}, kv.None, nil
+	}
+	return r.t.Search(key)
+}
+
+// VerifyChecksums 读取文件中所有的块并校验 CRC32C, 不受 SkipChecksums 配置的影响, 同时检查数据块能否解析
+// 版本 4 之前的文件没有校验和, 只检查能否解析
+func (r *SstReader) VerifyChecksums() error {
+	t := r.t
+	if t.metaInfo.version == versionJSON {
+		return t.scan(func(kv.Data) {})
+	}
+	blocks := []blockHandle{{offset: t.metaInfo.indexStart, length: t.metaInfo.indexLen}}
+	if t.hasFilter() {
+		blocks = append(blocks, blockHandle{offset: t.metaInfo.filterStart, length: t.metaInfo.filterLen})
+	}
+	if t.metaInfo.version >= versionProperties {
+		blocks = append(blocks, blockHandle{offset: t.metaInfo.propsStart, length: t.metaInfo.propsLen})
+	}
+	for _, h := range blocks {
+		if _, err := t.readBlockVerified(h.offset, h.length, true); err != nil {
+			return err
+		}
+	}
+	// 分区会在遍历数据块时读取, 这里先单独校验
+	if t.metaInfo.partitions > 0 {
+		for _, h := range t.index {
+			if _, err := t.readBlockVerified(h.offset, h.length, true); err != nil {
+				return err
+			}
+		}
+	}
+	iter, err := t.newIndexIter()
+	if err != nil {
+		return err
+	}
+	for iter.next() {
+		h := iter.handle()
+		block, err := t.readBlockVerified(h.offset, h.length, true)
+		if err != nil {
+			return err
+		}
+		if t.metaInfo.version >= versionCodec {
+			if block, err = uncompressBlock(block); err != nil {
+				return t.corruption(h.offset, "fail to uncompress the block: "+err.Error())
+			}
+		}
+		it, err := newBlockIter(block, t.metaInfo.version >= versionPrefix)
+		if err != nil {
+			return t.corruption(h.offset, err.Error())
+		}
+		for it.next() {
+		}
+		if it.err != nil {
+			return t.corruption(h.offset, it.err.Error())
+		}
+	}
+	return iter.err
+}
+
+// NewIterator 创建一个按 key 顺序遍历文件的迭代器, tombstones 为 true 时墓碑也会被遍历到
+func (r *SstReader) NewIterator(tombstones bool) *SstIterator {
+	return &SstIterator{t: r.t, tombstones: tombstones}
+}
+
+// Close 关闭文件, 之后不能再使用 SstReader 和它的迭代器
+func (r *SstReader) Close() error {
+	return r.t.close()
+}
+
+// SstIterator 按 key 的顺序遍历一个 SsTable, 每次只读取当前的数据块
+// 方法与 memTable.Iterator 一致, 遍历结束或出错时 Valid 返回 false, 通过 Error 区分
+type SstIterator struct {
+	t          *SsTable
+	tombstones bool
+	index      *indexIter // 当前数据块在稀疏索引中的位置
+	block      *blockIter // 当前数据块
+	entries    []kv.Data  // 版本 0 的文件没有顺序, 一次读出后排序
+	pos        int        // 当前元素在 entries 中的位置
+	entry      kv.Data
+	valid      bool
+	err        error
+}
+
+// SeekToFirst 定位到第一个元素
+func (it *SstIterator) SeekToFirst() {
+	if it.t.metaInfo.version == versionJSON {
+		it.Seek("")
+		return
+	}
+	it.reset()
+	if !it.resetIndex() {
+		return
+	}
+	it.next()
+	it.skip()
+}
+
+// Seek 定位到第一个 key 不小于给定 key 的元素
+func (it *SstIterator) Seek(key string) {
+	it.reset()
+	if it.t.metaInfo.version == versionJSON {
+		if it.entries == nil && !it.loadEntries() {
+			return
+		}
+		it.pos = sort.Search(len(it.entries), func(i int) bool {
+			return it.entries[i].Key >= key
+		})
+		it.settle()
+		it.skip()
+		return
+	}
+	// 只有第一个最大 key 不小于 key 的数据块可能包含 key
+	if !it.resetIndex() {
+		return
+	}
+	if !it.index.seek(key) {
+		it.err = it.index.err
+		return
+	}
+	if !it.load() {
+		return
+	}
+	if it.block.seek(key) {
+		it.entry, it.valid = it.block.entry, true
+	} else if it.block.err != nil {
+		it.err = it.t.corruption(it.index.handle().offset, it.block.err.Error())
+	} else {
+		it.next()
+	}
+	it.skip()
+}
+
+// Next 移动到下一个元素
+func (it *SstIterator) Next() {
+	if !it.valid {
+		return
+	}
+	if it.t.metaInfo.version == versionJSON {
+		it.pos++
+		it.settle()
+	} else {
+		it.next()
+	}
+	it.skip()
+}
+
+// Valid 判断迭代器是否指向一个元素
+func (it *SstIterator) Valid() bool {
+	return it.valid
+}
+
+// Entry 获取当前元素, 只能在 Valid 为 true 时调用
+func (it *SstIterator) Entry() kv.Data {
+	return it.entry
+}
+
+// Error 获取遍历时遇到的错误, 文件损坏时为 ErrCorruption
+func (it *SstIterator) Error() error {
+	return it.err
+}
+
+func (it *SstIterator) reset() {
+	it.valid, it.err = false, nil
+}
+
+// 重新创建稀疏索引的迭代器, 出错时返回 false
+func (it *SstIterator) resetIndex() bool {
+	it.block = nil
+	it.index, it.err = it.t.newIndexIter()
+	return it.err == nil
+}
+
+// 读取稀疏索引的迭代器指向的数据块, 出错时返回 false
+func (it *SstIterator) load() bool {
+	it.block = nil
+	h := it.index.handle()
+	// 遍历的数据块不加入块缓存
+	block, err := it.t.readBlock(h, false)
+	if err != nil {
+		it.err = err
+		return false
+	}
+	if it.block, err = newBlockIter(block, it.t.metaInfo.version >= versionPrefix); err != nil {
+		it.err = it.t.corruption(h.offset, err.Error())
+		return false
+	}
+	return true
+}
+
+// 移动到下一个元素, 当前数据块结束时读取下一个数据块
+func (it *SstIterator) next() {
+	it.valid = false
+	for {
+		if it.block != nil {
+			if it.block.next() {
+				it.entry, it.valid = it.block.entry, true
+				return
+			}
+			if it.block.err != nil {
+				it.err = it.t.corruption(it.index.handle().offset, it.block.err.Error())
+				return
+			}
+		}
+		if !it.index.next() {
+			it.err = it.index.err
+			return
+		}
+		if !it.load() {
+			return
+		}
+	}
+}
+
+// 不遍历墓碑时跳过它们
+func (it *SstIterator) skip() {
+	for it.valid && !it.tombstones && it.entry.Deleted {
+		if it.t.metaInfo.version == versionJSON {
+			it.pos++
+			it.settle()
+		} else {
+			it.next()
+		}
+	}
+}
+
+// 将版本 0 的文件中的元素全部读出并排序
+func (it *SstIterator) loadEntries() bool {
+	it.entries = []kv.Data{}
+	if err := it.t.scan(func(data kv.Data) {
+		it.entries = append(it.entries, data)
+	}); err != nil {
+		it.entries, it.err = nil, err
+		return false
+	}
+	sort.Slice(it.entries, func(i, j int) bool {
+		return it.entries[i].Key < it.entries[j].Key
+	})
+	return true
+}
+
+// 根据 pos 更新版本 0 的文件中的当前元素
+func (it *SstIterator) settle() {
+	it.valid = it.pos < len(it.entries)
+	if it.valid {
+		it.entry = it.entries[it.pos]
+	}
+}
@@ -0,0 +1,84 @@
+package ssTable
+
+import (
+	"errors"
+	"fmt"
+	"qlsm/codec"
+	"qlsm/kv"
+	"qlsm/vlog"
+	"time"
+)
+
+// ErrWriterFinished 表示 SstWriter 已经完成或放弃写入
+var ErrWriterFinished = errors.New("ssTable: the writer is finished")
+
+// SstWriter 在数据库之外将按 key 严格递增的元素写成一个 SsTable 文件, 生成的文件可以通过 IngestFiles 导入
+// 值应当与 Set 写入的一样是 JSON, 否则 Get 无法解析, 不需要启动数据库, 未初始化配置时使用默认的块大小和过滤器
+type SstWriter struct {
+	b       *tableBuilder
+	lastKey string
+	done    bool
+}
+
+// NewSstWriter 创建 path 并开始写入, 数据块使用 c 压缩, c 不是已知的压缩算法时返回错误
+func NewSstWriter(path string, c codec.Codec) (*SstWriter, error) {
+	if !c.Valid() {
+		return nil, fmt.Errorf("ssTable: unknown codec %d", byte(c))
+	}
+	b, err := newTableBuilder(path, Properties{CreatedAt: time.Now(), Codec: c})
+	if err != nil {
+		return nil, err
+	}
+	return &SstWriter{b: b}, nil
+}
+
+// Put 写入一个元素
+func (w *SstWriter) Put(key string, value []byte) error {
+	// 以指针的格式开头的值在读取时会被当作 ValueLog 中的指针
+	if _, ok := vlog.DecodePointer(value); ok {
+		return fmt.Errorf("ssTable: the value of %q has the format of a value log pointer", key)
+	}
+	return w.add(kv.Data{Key: key, Value: value})
+}
+
+// Delete 写入一个墓碑, 导入后会覆盖更旧的 SsTable 中的 key
+func (w *SstWriter) Delete(key string) error {
+	return w.add(kv.Data{Key: key, Deleted: true})
+}
+
+func (w *SstWriter) add(data kv.Data) error {
+	if w.done {
+		return ErrWriterFinished
+	}
+	if w.b.props.Entries > 0 && data.Key <= w.lastKey {
+		return fmt.Errorf("ssTable: key %q is not greater than the previous key %q", data.Key, w.lastKey)
+	}
+	w.lastKey = data.Key
+	return w.b.add(data)
+}
+
+// Finish 写入剩余的数据和元数据并关闭文件, 返回文件的属性, 没有写入任何元素时返回错误并删除文件
+func (w *SstWriter) Finish() (Properties, error) {
+	if w.done {
+		return Properties{}, ErrWriterFinished
+	}
+	w.done = true
+	if w.b.props.Entries == 0 {
+		w.b.abort()
+		return Properties{}, errors.New("ssTable: no entries were written")
+	}
+	if _, _, _, err := w.b.finish(); err != nil {
+		w.b.abort()
+		return Properties{}, err
+	}
+	return w.b.props, nil
+}
+
+// Abort 放弃写入并删除文件
+func (w *SstWriter) Abort() {
+	if w.done {
+		return
+	}
+	w.done = true
+	w.b.abort()
+}
@@ -1,12 +1,12 @@
 package ssTable
 
 import (
-	"encoding/json"
 	"log"
 	"os"
 	"path"
-	"path/filepath"
 	"qlsm/config"
+	"qlsm/memTable"
+	"sort"
 	"strconv"
 
 	"qlsm/kv"
@@ -14,172 +14,214 @@ import (
 	"time"
 )
 
-var levelMaxSize []int
-
-type tableNode struct {
-	index int
-	table *SsTable
-	next  *tableNode
-}
-
 // TablesTree 用于管理各层 SsTable
 type TablesTree struct {
-	levels []*tableNode
+	current   *version    // 当前的 SsTable 集合, 只在持有写锁时替换
+	nextIndex int         // 下一个文件编号, 各层的 SsTable 和 MANIFEST 共用
+	cache     *blockCache // 所有 SsTable 共享的块缓存
+	manifest  manifest    // 记录 TablesTree 修改历史的 MANIFEST
+	filterCounters
+	// 压实期间持有, 导入 SsTable 时通过 PauseCompaction 持有, 避免导入的 SsTable 所在的层被压实后清空
+	compaction sync.Mutex
 	sync.RWMutex
 }
 
-// Search 从所有 SsTable 表中查找数据
-func (tt *TablesTree) Search(key string) (kv.Data, kv.SearchResult) {
-	tt.RLock()
-	defer tt.RUnlock()
+// Search 从所有 SsTable 表中查找数据, 遇到损坏的 SsTable 时停止查找并返回 ErrCorruption
+// 不能跳过损坏的 SsTable 继续查找, 否则可能读到更旧的值
+// 查找期间持有当前的 version, 同时进行的压实不会阻塞查找, 也不会删除正在查找的 SsTable
+func (tt *TablesTree) Search(key string) (kv.Data, kv.SearchResult, error) {
+	v := tt.ref()
+	defer v.unref()
 	// 依次遍历每层 SsTable
-	for _, t := range tt.levels {
-		// 整理 SsTable 列表
-		var tables []*SsTable
-		for t != nil {
-			tables = append(tables, t.table)
-			t = t.next
-		}
+	for _, nodes := range v.levels {
 		// 从最新的 SsTable 开始查找
-		for i := len(tables) - 1; i >= 0; i-- {
-			value, searchResult := tables[i].Search(key)
+		for i := len(nodes) - 1; i >= 0; i-- {
+			t := nodes[i].table
+			// key 不在 SsTable 的范围内时跳过
+			if !t.inRange(key) {
+				continue
+			}
+			// 过滤器判定 key 不存在时跳过该 SsTable
+			if t.hasFilter() {
+				tt.filterCounters.checks.Add(1)
+				if !t.mayContain(key) {
+					tt.filterCounters.hits.Add(1)
+					continue
+				}
+			}
+			value, searchResult, err := t.Search(key)
+			if err != nil {
+				return kv.Data{}, kv.None, err
+			}
 			// 未找到, 则查找下一个 SsTable
 			if searchResult == kv.None {
+				if t.hasFilter() {
+					tt.filterCounters.misses.Add(1)
+				}
 				continue
 			}
 			// 如果找到或已被删除, 则直接返回结果
-			return value, searchResult
+			return value, searchResult, nil
 		}
 	}
 	// 没有找到
-	return kv.Data{}, kv.None
+	return kv.Data{}, kv.None, nil
 }
 
-// Insert 在 TablesTree 的 level 层的末尾插入 SsTable, 并返回新插入的 SsTable 的 index
-func (tt *TablesTree) Insert(t *SsTable, level int) (index int) {
+// 分配下一个文件编号
+func (tt *TablesTree) allocIndex() int {
 	tt.Lock()
 	defer tt.Unlock()
-	curr := tt.levels[level]
-	newNode := &tableNode{table: t}
-	// 简单的按序插入逻辑
-	if curr == nil {
-		tt.levels[level] = newNode
-	} else {
-		for curr.next != nil {
-			curr = curr.next
-		}
-		newNode.index = curr.index + 1
-		curr.next = newNode
-	}
-	return newNode.index
+	index := tt.nextIndex
+	tt.nextIndex++
+	return index
+}
+
+// WalNumber 获取 MANIFEST 中记录的 Wal 段编号, 编号小于它的段中的数据都已写入 SsTable
+func (tt *TablesTree) WalNumber() int {
+	tt.RLock()
+	defer tt.RUnlock()
+	return tt.current.walNumber
+}
+
+// LastSeq 获取 MANIFEST 中记录的已写入 SsTable 的最大序列号
+func (tt *TablesTree) LastSeq() uint64 {
+	tt.RLock()
+	defer tt.RUnlock()
+	return tt.current.lastSeq
 }
 
-// Init 初始化 TablesTree
+// Init 初始化 TablesTree, 根据 MANIFEST 加载存活的 SsTable, 删除残留的文件, 然后写入一个新的 MANIFEST
+// 没有 MANIFEST 的旧版本数据库根据文件名加载所有 SsTable
 func (tt *TablesTree) Init(dir string) {
 	start := time.Now()
 	defer func() { log.Println("load the TablesTree , consumption of time:", time.Since(start)) }()
-	// 获取各层文件大小
-	cfg := config.GetConfig()
-	levelMaxSize = make([]int, 10)
-	levelMaxSize[0] = cfg.Level0Size
-	for i := 1; i < 10; i++ {
-		levelMaxSize[i] = levelMaxSize[i-1] << 2
-	}
-	// 加载各层 db 文件
-	tt.levels = make([]*tableNode, cfg.PartSize)
+	tt.cache = newBlockCache()
 	files, err := os.ReadDir(dir)
 	if err != nil {
 		log.Panicln("failed to read the database files:", err.Error())
 	}
+	var onDisk []tableFile
 	for _, f := range files {
-		if path.Ext(f.Name()) == ".db" {
-			tt.loadDBFile(path.Join(dir, f.Name()))
+		switch path.Ext(f.Name()) {
+		case ".db":
+			level, index, err := getSsTableInfo(f.Name())
+			if err != nil {
+				log.Println("can not load the", path.Join(dir, f.Name()))
+				continue
+			}
+			onDisk = append(onDisk, tableFile{level: level, index: index})
+		case ingestSuffix:
+			// 导入过程中崩溃残留的临时文件
+			_ = os.Remove(path.Join(dir, f.Name()))
+		}
+	}
+	state, ok := readManifest(dir)
+	if !ok {
+		log.Println("no MANIFEST is found, load all the db files")
+		for _, f := range onDisk {
+			state.live[f] = struct{}{}
 		}
 	}
+	for _, f := range onDisk {
+		if _, ok := state.live[f]; !ok {
+			log.Println("delete the file which is not in the MANIFEST:", tablePath(dir, f))
+			_ = os.Remove(tablePath(dir, f))
+		}
+	}
+
+	// 加载各层 db 文件, 同一层中编号越大的 SsTable 越新
+	live := make([]tableFile, 0, len(state.live))
+	for f := range state.live {
+		live = append(live, f)
+	}
+	sort.Slice(live, func(i, j int) bool {
+		if live[i].level != live[j].level {
+			return live[i].level < live[j].level
+		}
+		return live[i].index < live[j].index
+	})
+	tt.nextIndex = state.nextIndex
+	for i := range live {
+		live[i].table = tt.loadDBFile(dir, live[i])
+	}
+	tt.current = newVersion(numLevels()).apply(versionEdit{added: live, lastSeq: state.lastSeq, walNumber: state.walNumber})
+	// 每次启动都写入新的 MANIFEST, 旧的 MANIFEST 不会无限增长, 末尾不完整的记录也随之丢弃
+	number := tt.allocIndex()
+	tt.manifest.dir = dir
+	tt.manifest.roll(number, tt.current.snapshot(tt.nextIndex))
 }
 
-// 加载一个 db 文件到 TablesTree 中
-func (tt *TablesTree) loadDBFile(path string) {
+// 加载一个 db 文件
+func (tt *TablesTree) loadDBFile(dir string, f tableFile) *SsTable {
 	start := time.Now()
+	filePath := tablePath(dir, f)
 	defer func() {
-		log.Printf("load the %s, consumption of time: %v", path, time.Since(start))
+		log.Printf("load the %s, consumption of time: %v", filePath, time.Since(start))
 	}()
-	// 获取 db 对应的 level 和 index 信息
-	level, index, err := getSsTableInfo(filepath.Base(path))
-	if err != nil {
-		log.Println("can not load the", path)
-		return
+	if levels := numLevels(); f.level >= levels {
+		log.Panicf("the %s is in level %d, but there are only %d levels, increase NumLevels to open it\n", filePath, f.level, levels)
 	}
-	t := &SsTable{}
-	t.Load(path)
-	newNode := &tableNode{index: index, table: t}
-
-	// 根据 index 将 SsTable 插入到合适的位置
-	curr := tt.levels[level]
-	if curr == nil || curr.index > newNode.index {
-		tt.levels[level] = newNode
-		newNode.next = curr
-		return
+	t := tt.newTable(f.level)
+	t.Load(filePath)
+	if f.index >= tt.nextIndex {
+		tt.nextIndex = f.index + 1
 	}
-	for curr.next != nil && curr.next.index <= newNode.index {
-		curr = curr.next
-	}
-	newNode.next = curr.next
-	curr.next = newNode
+	return t
 }
 
-// CreateTable 为对应层生成 SsTable
-func (tt *TablesTree) CreateTable(values []kv.Data, level int) *SsTable {
-	// 生成数据区
-	positions := map[string]Position{}
-	var dataArea []byte
-	for _, value := range values {
-		data, err := json.Marshal(value)
-		if err != nil {
-			log.Println("failed to Insert Key:", value.Key, err)
-			continue
-		}
-		positions[value.Key] = Position{
-			Start:   int64(len(dataArea)),
-			Len:     int64(len(data)),
-			Deleted: value.Deleted,
-		}
-		dataArea = append(dataArea, data...)
-	}
-
-	// 生成稀疏索引区
-	indexArea, err := json.Marshal(positions)
-	if err != nil {
-		log.Fatal("an SsTable file cannot be created,", err)
-	}
-
-	meta := MetaInfo{
-		version:    0,
-		dataStart:  0,
-		dataLen:    int64(len(dataArea)),
-		indexStart: int64(len(dataArea)),
-		indexLen:   int64(len(indexArea)),
-	}
+// 获取 SsTable 文件的路径
+func tablePath(dir string, f tableFile) string {
+	return dir + "/" + strconv.Itoa(f.level) + "." + strconv.Itoa(f.index) + ".db"
+}
 
-	table := &SsTable{
-		metaInfo:    meta,
-		sparseIndex: positions,
+// 创建一个属于 level 层的空 SsTable, 根据配置决定索引和过滤器是否常驻内存
+func (tt *TablesTree) newTable(level int) *SsTable {
+	cfg := config.GetConfig()
+	return &SsTable{
+		number:    nextTableNumber.Add(1),
+		cache:     tt.cache,
+		cacheMeta: tt.cache != nil && cfg.CacheIndexAndFilterBlocks && !(level == 0 && cfg.PinL0IndexAndFilterBlocks),
 	}
+}
 
-	index := tt.Insert(table, level)
+// CreateTable 将 it 中的元素按顺序写入对应层的新 SsTable 并记录到 MANIFEST, seqs 为这些元素在 Wal 中的序列号范围
+// walNumber 大于 0 时表示编号小于它的 Wal 段中的数据都已写入 SsTable, 与新的 SsTable 一起记录
+func (tt *TablesTree) CreateTable(it memTable.Iterator, level int, seqs SeqRange, walNumber int) *SsTable {
+	table, index := tt.buildTable(it, level, seqs)
+	tt.logAndApply(versionEdit{
+		added:     []tableFile{{level: level, index: index, table: table}},
+		lastSeq:   seqs.Max,
+		walNumber: walNumber,
+	})
 	log.Printf("create a new SsTable, level: %d, index: %d\n", level, index)
-	cfg := config.GetConfig()
-	filePath := cfg.DataDir + "/" + strconv.Itoa(level) + "." + strconv.Itoa(index) + ".db"
-	table.filepath = filePath
+	return table
+}
 
-	writeDataToFile(filePath, dataArea, indexArea, meta)
+// 将 it 中的元素按顺序写入对应层的新 SsTable 并打开, 返回它和它的文件编号, 此时还没有加入 TablesTree
+func (tt *TablesTree) buildTable(it memTable.Iterator, level int, seqs SeqRange) (*SsTable, int) {
+	table := tt.newTable(level)
+
+	// 先写入并打开文件, 再加入 TablesTree, 保证读者看到的 SsTable 都是可读的
+	index := tt.allocIndex()
+	table.filepath = tablePath(config.GetConfig().DataDir, tableFile{level: level, index: index})
+
+	tableIndex, filter, props, meta := writeDataToFile(table.filepath, it, Properties{
+		CreatedAt: time.Now(),
+		MinSeq:    seqs.Min,
+		MaxSeq:    seqs.Max,
+		Codec:     levelCodec(level),
+		Level:     level,
+	})
+	table.metaInfo = meta
+	table.props = &props
+	if !table.cacheMeta {
+		table.index, table.filter = tableIndex, filter
+	}
 	// 以只读的形式打开文件
-	f, err := os.OpenFile(table.filepath, os.O_RDONLY, 0666)
-	if err != nil {
+	if err := table.open(); err != nil {
 		log.Println("fail to open file", table.filepath)
 		panic(err)
 	}
-	table.f = f
-
-	return table
+	return table, index
 }
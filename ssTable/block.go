@@ -0,0 +1,338 @@
+package ssTable
+
+import (
+	"encoding/binary"
+	"errors"
+	"qlsm/codec"
+	"qlsm/config"
+	"qlsm/kv"
+	"sort"
+	"unsafe"
+)
+
+/*
+数据块由按 key 排好序的元素依次拼接而成, 版本 6 之前每个元素的格式为
+┌───────┬──────────────────┬────────────────────┬─────┬───────┐
+│ flags │ keyLen (uvarint) │ valueLen (uvarint) │ key │ value │
+└───────┴──────────────────┴────────────────────┴─────┴───────┘
+从版本 6 开始, 每个元素只保存与前一个 key 不同的后缀, 格式为
+┌───────┬──────────────────┬────────────────────┬────────────────────┬─────────────────┬───────┐
+│ flags │ shared (uvarint) │ unshared (uvarint) │ valueLen (uvarint) │ key[shared:]    │ value │
+└───────┴──────────────────┴────────────────────┴────────────────────┴─────────────────┴───────┘
+每隔 BlockRestartInterval 个元素设置一个重启点, 重启点处的元素 shared 为 0, 保存完整的 key
+元素之后是每个重启点的位置 (uint32) 和重启点的数量 (uint32), 查找时可以先在重启点中二分查找
+从版本 3 开始, 数据块以一个字节的压缩算法开头, 之后是压缩后的元素, 见 codec.Codec
+索引区为每个数据块保存一个条目, 格式为
+┌──────────────────┬─────────┬───────────────────┬───────────────────┐
+│ keyLen (uvarint) │ lastKey │ offset (uvarint)  │ length (uvarint)  │
+└──────────────────┴─────────┴───────────────────┴───────────────────┘
+*/
+
+const (
+	defaultBlockSize       = 4 << 10 // 默认的数据块大小
+	defaultRestartInterval = 16      // 默认的重启点间隔
+	flagDeleted            = 1       // 元素是墓碑
+)
+
+// errBadBlock 表示数据块或索引区无法解析
+var errBadBlock = errors.New("ssTable: malformed block")
+
+// blockHandle 是索引区中的一个条目, 指向一个数据块
+type blockHandle struct {
+	lastKey string // 数据块中最大的 key
+	offset  int64  // 数据块在文件中的位置
+	length  int64  // 数据块的长度
+}
+
+// blockHandle 在内存中占用的大小, 不包括 lastKey 的内容
+var blockHandleSize = int64(unsafe.Sizeof(blockHandle{}))
+
+// 获取配置的数据块大小
+func blockSize() int {
+	if size := config.GetConfig().BlockSize; size > 0 {
+		return size
+	}
+	return defaultBlockSize
+}
+
+// 获取配置的重启点间隔
+func restartInterval() int {
+	if interval := config.GetConfig().BlockRestartInterval; interval > 0 {
+		return interval
+	}
+	return defaultRestartInterval
+}
+
+// 获取 level 层的数据块使用的压缩算法, 超出配置长度的层使用最后一个
+func levelCodec(level int) codec.Codec {
+	codecs := config.GetConfig().LevelCompression
+	if len(codecs) == 0 {
+		return codec.None
+	}
+	if level >= len(codecs) {
+		return codecs[len(codecs)-1]
+	}
+	return codecs[level]
+}
+
+// 使用 c 压缩数据块并加上压缩算法的头部, 追加到 dst 后返回, 压缩效果不明显时不压缩
+func compressBlock(dst []byte, raw []byte, c codec.Codec) ([]byte, error) {
+	if c != codec.None {
+		start := len(dst)
+		var err error
+		if dst, err = c.Encode(append(dst, byte(c)), raw); err != nil {
+			return nil, err
+		}
+		// 至少节省 1/8 的空间才值得解压的开销
+		if len(dst)-start-1 < len(raw)-len(raw)/8 {
+			return dst, nil
+		}
+		dst = dst[:start]
+	}
+	dst = append(dst, byte(codec.None))
+	return append(dst, raw...), nil
+}
+
+// 根据头部的压缩算法解压数据块
+func uncompressBlock(stored []byte) ([]byte, error) {
+	if len(stored) == 0 {
+		return nil, errBadBlock
+	}
+	return codec.Codec(stored[0]).Decode(stored[1:])
+}
+
+// blockBuilder 将元素编码成一个数据块
+type blockBuilder struct {
+	buf      []byte
+	lastKey  string
+	restarts []uint32 // 重启点在块中的位置
+	counter  int      // 上一个重启点之后的元素数量
+	interval int      // 重启点的间隔
+}
+
+// 追加一个元素, 元素需要按 key 的顺序追加
+func (b *blockBuilder) add(data kv.Data) {
+	shared := 0
+	if len(b.restarts) > 0 && b.counter < b.interval {
+		shared = sharedPrefixLen(b.lastKey, data.Key)
+	} else {
+		b.restarts = append(b.restarts, uint32(len(b.buf)))
+		b.counter = 0
+	}
+	b.counter++
+	var flags byte
+	if data.Deleted {
+		flags |= flagDeleted
+	}
+	b.buf = append(b.buf, flags)
+	b.buf = binary.AppendUvarint(b.buf, uint64(shared))
+	b.buf = binary.AppendUvarint(b.buf, uint64(len(data.Key)-shared))
+	b.buf = binary.AppendUvarint(b.buf, uint64(len(data.Value)))
+	b.buf = append(b.buf, data.Key[shared:]...)
+	b.buf = append(b.buf, data.Value...)
+	b.lastKey = data.Key
+}
+
+// 完成后数据块的大小
+func (b *blockBuilder) size() int {
+	return len(b.buf) + 4*len(b.restarts) + 4
+}
+
+// 在元素之后写入重启点, 返回完整的数据块
+func (b *blockBuilder) finish() []byte {
+	for _, r := range b.restarts {
+		b.buf = binary.LittleEndian.AppendUint32(b.buf, r)
+	}
+	b.buf = binary.LittleEndian.AppendUint32(b.buf, uint32(len(b.restarts)))
+	return b.buf
+}
+
+func (b *blockBuilder) reset() {
+	b.buf = b.buf[:0]
+	b.lastKey = ""
+	b.restarts = b.restarts[:0]
+	b.counter = 0
+}
+
+func (b *blockBuilder) empty() bool {
+	return len(b.buf) == 0
+}
+
+// 获取 a 和 b 的公共前缀长度
+func sharedPrefixLen(a string, b string) int {
+	n := 0
+	for n < len(a) && n < len(b) && a[n] == b[n] {
+		n++
+	}
+	return n
+}
+
+// blockIter 按顺序遍历一个数据块中的元素
+type blockIter struct {
+	data     []byte // 元素所在的区域
+	restarts []byte // 重启点, 每个 4 字节
+	prefixed bool   // 元素是否只保存与前一个 key 不同的部分
+	offset   int    // 下一个元素的位置
+	key      []byte // 当前元素的 key
+	entry    kv.Data
+	err      error
+}
+
+// 创建遍历 block 的 blockIter, 版本 6 之前的数据块没有前缀压缩和重启点
+func newBlockIter(block []byte, prefixed bool) (*blockIter, error) {
+	it := &blockIter{data: block, prefixed: prefixed}
+	if !prefixed {
+		return it, nil
+	}
+	if len(block) < 4 {
+		return nil, errBadBlock
+	}
+	n := uint64(binary.LittleEndian.Uint32(block[len(block)-4:]))
+	if n*4+4 > uint64(len(block)) {
+		return nil, errBadBlock
+	}
+	start := len(block) - 4 - int(n)*4
+	it.data, it.restarts = block[:start], block[start:len(block)-4]
+	return it, nil
+}
+
+// 解码 offset 处元素的头部, 返回标志、共享前缀长度、key 的剩余部分、值和下一个元素的位置
+func (it *blockIter) decode(offset int) (flags byte, shared int, unshared []byte, value []byte, next int, err error) {
+	block := it.data
+	if offset >= len(block) {
+		return 0, 0, nil, nil, 0, errBadBlock
+	}
+	flags = block[offset]
+	offset++
+	var fields [3]uint64
+	lengths := fields[1:]
+	if it.prefixed {
+		lengths = fields[:]
+	}
+	for i := range lengths {
+		v, n := binary.Uvarint(block[offset:])
+		if n <= 0 {
+			return 0, 0, nil, nil, 0, errBadBlock
+		}
+		lengths[i] = v
+		offset += n
+	}
+	keyLen, valueLen := fields[1], fields[2]
+	if uint64(len(block)-offset) < keyLen || uint64(len(block)-offset)-keyLen < valueLen {
+		return 0, 0, nil, nil, 0, errBadBlock
+	}
+	unshared = block[offset : offset+int(keyLen)]
+	offset += int(keyLen)
+	value = block[offset : offset+int(valueLen) : offset+int(valueLen)]
+	return flags, int(fields[0]), unshared, value, offset + int(valueLen), nil
+}
+
+// 移动到下一个元素, 遍历结束或出错时返回 false
+func (it *blockIter) next() bool {
+	if it.err != nil || it.offset >= len(it.data) {
+		return false
+	}
+	flags, shared, unshared, value, next, err := it.decode(it.offset)
+	if err == nil && shared > len(it.key) {
+		err = errBadBlock
+	}
+	if err != nil {
+		it.err = err
+		return false
+	}
+	it.key = append(it.key[:shared], unshared...)
+	it.entry = kv.Data{Key: string(it.key)}
+	if flags&flagDeleted != 0 {
+		it.entry.Deleted = true
+	} else {
+		it.entry.Value = value
+	}
+	it.offset = next
+	return true
+}
+
+// 定位到第一个 key 不小于给定 key 的元素, 没有这样的元素或出错时返回 false
+// 先在重启点中二分查找, 再从最后一个 key 小于给定 key 的重启点开始顺序查找
+func (it *blockIter) seek(key string) bool {
+	start := 0
+	if n := len(it.restarts) / 4; n > 0 {
+		i := sort.Search(n, func(i int) bool {
+			_, shared, restartKey, _, _, err := it.decode(it.restart(i))
+			if err != nil || shared != 0 {
+				it.err = errBadBlock
+				return true
+			}
+			return string(restartKey) >= key
+		})
+		if it.err != nil {
+			return false
+		}
+		if i > 0 {
+			start = it.restart(i - 1)
+		}
+	}
+	it.offset = start
+	it.key = it.key[:0]
+	for it.next() {
+		if it.entry.Key >= key {
+			return true
+		}
+	}
+	return false
+}
+
+// 第 i 个重启点的位置
+func (it *blockIter) restart(i int) int {
+	return int(binary.LittleEndian.Uint32(it.restarts[i*4:]))
+}
+
+// 在数据块中查找 key
+func searchBlock(block []byte, key string, prefixed bool) (kv.Data, bool, error) {
+	it, err := newBlockIter(block, prefixed)
+	if err != nil {
+		return kv.Data{}, false, err
+	}
+	if it.seek(key) && it.entry.Key == key {
+		return it.entry, true, nil
+	}
+	return kv.Data{}, false, it.err
+}
+
+// 编码索引区
+func encodeIndex(index []blockHandle) []byte {
+	var buf []byte
+	for _, h := range index {
+		buf = binary.AppendUvarint(buf, uint64(len(h.lastKey)))
+		buf = append(buf, h.lastKey...)
+		buf = binary.AppendUvarint(buf, uint64(h.offset))
+		buf = binary.AppendUvarint(buf, uint64(h.length))
+	}
+	return buf
+}
+
+// 解码索引区
+func decodeIndex(buf []byte) ([]blockHandle, error) {
+	var index []blockHandle
+	for len(buf) > 0 {
+		keyLen, n := binary.Uvarint(buf)
+		if n <= 0 || uint64(len(buf)-n) < keyLen {
+			return nil, errBadBlock
+		}
+		buf = buf[n:]
+		h := blockHandle{lastKey: string(buf[:keyLen])}
+		buf = buf[keyLen:]
+		offset, n := binary.Uvarint(buf)
+		if n <= 0 {
+			return nil, errBadBlock
+		}
+		buf = buf[n:]
+		length, n := binary.Uvarint(buf)
+		if n <= 0 {
+			return nil, errBadBlock
+		}
+		buf = buf[n:]
+		h.offset, h.length = int64(offset), int64(length)
+		index = append(index, h)
+	}
+	return index, nil
+}
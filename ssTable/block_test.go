@@ -0,0 +1,267 @@
+package ssTable
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"qlsm/codec"
+	"qlsm/kv"
+	"sort"
+	"testing"
+)
+
+// 有较长公共前缀、前缀为空和 key 是下一个 key 的前缀的元素
+var blockKeys = []string{
+	"a", "app", "apple", "applesauce", "apply", "apricot",
+	"b", "ba", "banana", "bandana", "band",
+	"user:0001", "user:0002", "user:0010", "user:0100", "user:1000",
+	"z",
+}
+
+func sortedBlockKeys() []string {
+	keys := append([]string(nil), blockKeys...)
+	sort.Strings(keys)
+	return keys
+}
+
+// 按 interval 构建一个数据块, 每 3 个元素中有一个墓碑
+func buildBlock(keys []string, interval int) ([]byte, []kv.Data) {
+	b := blockBuilder{interval: interval}
+	var entries []kv.Data
+	for i, key := range keys {
+		data := kv.Data{Key: key, Value: []byte("v-" + key)}
+		if i%3 == 2 {
+			data = kv.Data{Key: key, Deleted: true}
+		}
+		b.add(data)
+		entries = append(entries, data)
+	}
+	return b.finish(), entries
+}
+
+func sameEntry(a kv.Data, b kv.Data) bool {
+	return a.Key == b.Key && a.Deleted == b.Deleted && bytes.Equal(a.Value, b.Value)
+}
+
+func TestBlockRoundTrip(t *testing.T) {
+	keys := sortedBlockKeys()
+	for _, interval := range []int{1, 2, 3, 4, 16, len(keys), len(keys) + 1} {
+		block, entries := buildBlock(keys, interval)
+		it, err := newBlockIter(block, true)
+		if err != nil {
+			t.Fatalf("interval %d: %v", interval, err)
+		}
+		// 每 interval 个元素一个重启点
+		if want := (len(keys) + interval - 1) / interval; len(it.restarts)/4 != want {
+			t.Fatalf("interval %d: %d restart points, want %d", interval, len(it.restarts)/4, want)
+		}
+		for i := 0; i < len(it.restarts)/4; i++ {
+			_, shared, key, _, _, err := it.decode(it.restart(i))
+			if err != nil || shared != 0 || string(key) != keys[i*interval] {
+				t.Fatalf("interval %d: restart point %d holds %q shared %d, want the full key %q", interval, i, key, shared, keys[i*interval])
+			}
+		}
+		n := 0
+		for it.next() {
+			if !sameEntry(it.entry, entries[n]) {
+				t.Fatalf("interval %d: entry %d is %+v, want %+v", interval, n, it.entry, entries[n])
+			}
+			n++
+		}
+		if it.err != nil || n != len(entries) {
+			t.Fatalf("interval %d: read %d entries, err %v", interval, n, it.err)
+		}
+	}
+}
+
+func TestBlockPrefixCompression(t *testing.T) {
+	keys := sortedBlockKeys()
+	compressed, _ := buildBlock(keys, 16)
+	full, _ := buildBlock(keys, 1)
+	if len(compressed) >= len(full) {
+		t.Fatalf("the prefix-compressed block has %d bytes, the uncompressed one has %d", len(compressed), len(full))
+	}
+}
+
+func TestBlockSeek(t *testing.T) {
+	keys := sortedBlockKeys()
+	cases := []struct {
+		seek string
+		want string // 为空时定位失败
+	}{
+		{"", keys[0]},
+		{"0", keys[0]},
+		{"a", "a"},
+		{"ap", "app"},
+		{"applesauce", "applesauce"},
+		{"applf", "apply"},
+		{"b", "b"},
+		{"bana", "banana"},
+		{"bandb", "user:0001"},
+		{"user:0003", "user:0010"},
+		{"user:1000", "user:1000"},
+		{"y", "z"},
+		{"z", "z"},
+		{"z0", ""},
+		{"~", ""},
+	}
+	// 重启点的边界前后都要能定位, 间隔为 1 时每个元素都是重启点
+	for _, interval := range []int{1, 2, 3, 4, 16} {
+		block, _ := buildBlock(keys, interval)
+		for _, c := range cases {
+			it, err := newBlockIter(block, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ok := it.seek(c.seek)
+			if it.err != nil {
+				t.Fatalf("interval %d: seek(%q): %v", interval, c.seek, it.err)
+			}
+			if c.want == "" {
+				if ok {
+					t.Fatalf("interval %d: seek(%q) found %q, want nothing", interval, c.seek, it.entry.Key)
+				}
+				continue
+			}
+			if !ok || it.entry.Key != c.want {
+				t.Fatalf("interval %d: seek(%q) = %q %v, want %q", interval, c.seek, it.entry.Key, ok, c.want)
+			}
+			// 定位后可以继续向后遍历
+			for i, key := range keys {
+				if key == c.want && i+1 < len(keys) {
+					if !it.next() || it.entry.Key != keys[i+1] {
+						t.Fatalf("interval %d: next after seek(%q) = %q, want %q", interval, c.seek, it.entry.Key, keys[i+1])
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestSearchBlock(t *testing.T) {
+	keys := sortedBlockKeys()
+	block, entries := buildBlock(keys, 3)
+	for _, e := range entries {
+		got, ok, err := searchBlock(block, e.Key, true)
+		if err != nil || !ok || !sameEntry(got, e) {
+			t.Fatalf("searchBlock(%q) = %+v %v %v, want %+v", e.Key, got, ok, err, e)
+		}
+	}
+	for _, key := range []string{"", "ap", "appl", "bandanas", "user:", "zz"} {
+		if got, ok, err := searchBlock(block, key, true); ok || err != nil {
+			t.Fatalf("searchBlock(%q) = %+v %v %v, want not found", key, got, ok, err)
+		}
+	}
+}
+
+// 版本 6 之前的数据块中每个元素保存完整的 key, 没有重启点
+func TestBlockWithoutPrefix(t *testing.T) {
+	keys := sortedBlockKeys()
+	var block []byte
+	for i, key := range keys {
+		var flags byte
+		value := []byte("v-" + key)
+		if i%3 == 2 {
+			flags, value = flagDeleted, nil
+		}
+		block = append(block, flags)
+		block = binary.AppendUvarint(block, uint64(len(key)))
+		block = binary.AppendUvarint(block, uint64(len(value)))
+		block = append(block, key...)
+		block = append(block, value...)
+	}
+	_, entries := buildBlock(keys, 1)
+	it, err := newBlockIter(block, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	for it.next() {
+		if !sameEntry(it.entry, entries[n]) {
+			t.Fatalf("entry %d is %+v, want %+v", n, it.entry, entries[n])
+		}
+		n++
+	}
+	if it.err != nil || n != len(entries) {
+		t.Fatalf("read %d entries, err %v", n, it.err)
+	}
+	if got, ok, err := searchBlock(block, "bandana", false); err != nil || !ok || string(got.Value) != "v-bandana" {
+		t.Fatalf("searchBlock(bandana) = %+v %v %v", got, ok, err)
+	}
+	if _, ok, err := searchBlock(block, "bandanas", false); ok || err != nil {
+		t.Fatalf("searchBlock(bandanas) = %v %v, want not found", ok, err)
+	}
+}
+
+func TestMalformedBlock(t *testing.T) {
+	block, _ := buildBlock(sortedBlockKeys(), 4)
+	// 重启点数量超出数据块
+	bad := append([]byte(nil), block...)
+	binary.LittleEndian.PutUint32(bad[len(bad)-4:], 1<<20)
+	if _, err := newBlockIter(bad, true); err != errBadBlock {
+		t.Fatalf("newBlockIter with too many restart points returned %v", err)
+	}
+	// 截断的元素
+	it, err := newBlockIter(block[:7], false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for it.next() {
+	}
+	if it.err != errBadBlock {
+		t.Fatalf("reading a truncated block returned %v", it.err)
+	}
+}
+
+func TestCompressBlock(t *testing.T) {
+	raw := bytes.Repeat([]byte("a block with repeated content "), 50)
+	for _, c := range []codec.Codec{codec.None, codec.Flate, codec.Zlib, codec.LZ} {
+		stored, err := compressBlock(nil, raw, c)
+		if err != nil {
+			t.Fatalf("%v: %v", c, err)
+		}
+		if c != codec.None && len(stored) >= len(raw) {
+			t.Fatalf("%v: the compressed block has %d bytes, the raw one has %d", c, len(stored), len(raw))
+		}
+		got, err := uncompressBlock(stored)
+		if err != nil || !bytes.Equal(got, raw) {
+			t.Fatalf("%v: the block does not round trip, err %v", c, err)
+		}
+	}
+	// 压缩效果不明显时不压缩
+	stored, err := compressBlock(nil, []byte("abc"), codec.Flate)
+	if err != nil || codec.Codec(stored[0]) != codec.None {
+		t.Fatalf("a short block should be stored uncompressed, got codec %d, err %v", stored[0], err)
+	}
+	if _, err = compressBlock(nil, raw, codec.Codec(200)); err == nil {
+		t.Fatal("compressing with an unknown codec should fail")
+	}
+}
+
+func TestIndexRoundTrip(t *testing.T) {
+	var index []blockHandle
+	for i := 0; i < 20; i++ {
+		index = append(index, blockHandle{lastKey: fmt.Sprintf("key%03d", i), offset: int64(i) * 300, length: 300})
+	}
+	got, err := decodeIndex(encodeIndex(index))
+	if err != nil || len(got) != len(index) {
+		t.Fatalf("decodeIndex returned %d handles, err %v", len(got), err)
+	}
+	for i := range index {
+		if got[i] != index[i] {
+			t.Fatalf("handle %d is %+v, want %+v", i, got[i], index[i])
+		}
+	}
+	// 每个分区编码后不小于分区大小, 拼接后与原索引相同
+	parts := partitionIndex(index, 40)
+	var joined []blockHandle
+	for i, part := range parts {
+		if i < len(parts)-1 && len(encodeIndex(part)) < 40 {
+			t.Fatalf("partition %d has %d bytes, want at least 40", i, len(encodeIndex(part)))
+		}
+		joined = append(joined, part...)
+	}
+	if len(parts) < 2 || len(joined) != len(index) {
+		t.Fatalf("partitionIndex split %d handles into %d partitions", len(joined), len(parts))
+	}
+}
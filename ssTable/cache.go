@@ -0,0 +1,144 @@
+package ssTable
+
+import (
+	"container/list"
+	"qlsm/config"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	defaultBlockCacheSize = 8 << 20 // 默认的块缓存容量
+	cacheShardCount       = 16      // 块缓存的分片数量
+)
+
+// 为每个打开的 SsTable 分配进程内唯一的编号, 文件删除后编号不会被复用, 缓存中不会读到旧文件的块
+var nextTableNumber atomic.Uint64
+
+// cacheKey 由 SsTable 的编号和块在文件中的位置组成
+type cacheKey struct {
+	number uint64
+	offset int64
+}
+
+type cacheEntry struct {
+	key    cacheKey
+	value  any   // 解压后的数据块, 或者解码后的索引和过滤器
+	charge int64 // 占用的容量
+}
+
+// cacheShard 是块缓存的一个分片, 按 LRU 淘汰
+type cacheShard struct {
+	capacity int64
+	size     int64
+	items    map[cacheKey]*list.Element
+	lru      list.List // 从新到旧排列
+	sync.Mutex
+}
+
+// blockCache 是所有 SsTable 共享的分片 LRU 块缓存, 缓存的内容不能被修改
+// 为 nil 时不缓存, 所有方法都可以在 nil 上调用
+type blockCache struct {
+	shards [cacheShardCount]cacheShard
+	hits   atomic.Int64
+	misses atomic.Int64
+}
+
+// 根据配置创建块缓存, 容量为负数时返回 nil
+func newBlockCache() *blockCache {
+	capacity := config.GetConfig().BlockCacheSize
+	if capacity < 0 {
+		return nil
+	}
+	if capacity == 0 {
+		capacity = defaultBlockCacheSize
+	}
+	c := &blockCache{}
+	for i := range c.shards {
+		c.shards[i].capacity = capacity / cacheShardCount
+		c.shards[i].items = map[cacheKey]*list.Element{}
+	}
+	return c
+}
+
+func (c *blockCache) shard(key cacheKey) *cacheShard {
+	h := key.number*0x9e3779b97f4a7c15 ^ uint64(key.offset)*0xbf58476d1ce4e5b9
+	return &c.shards[h>>60%cacheShardCount]
+}
+
+// 查找缓存的块, 并将其移动到 LRU 的头部
+func (c *blockCache) get(key cacheKey) (any, bool) {
+	if c == nil {
+		return nil, false
+	}
+	s := c.shard(key)
+	s.Lock()
+	defer s.Unlock()
+	e, ok := s.items[key]
+	if !ok {
+		c.misses.Add(1)
+		return nil, false
+	}
+	c.hits.Add(1)
+	s.lru.MoveToFront(e)
+	return e.Value.(*cacheEntry).value, true
+}
+
+// 加入一个块, 超出容量时淘汰最久未使用的块, 比整个分片还大的块不会被缓存
+func (c *blockCache) put(key cacheKey, value any, charge int64) {
+	if c == nil {
+		return
+	}
+	s := c.shard(key)
+	s.Lock()
+	defer s.Unlock()
+	if charge > s.capacity {
+		return
+	}
+	if e, ok := s.items[key]; ok {
+		s.size -= e.Value.(*cacheEntry).charge
+		s.lru.Remove(e)
+	}
+	s.items[key] = s.lru.PushFront(&cacheEntry{key: key, value: value, charge: charge})
+	s.size += charge
+	for s.size > s.capacity {
+		oldest := s.lru.Back()
+		entry := oldest.Value.(*cacheEntry)
+		s.lru.Remove(oldest)
+		delete(s.items, entry.key)
+		s.size -= entry.charge
+	}
+}
+
+// CacheStats 是块缓存的统计信息
+type CacheStats struct {
+	Hits     int64 // 命中次数
+	Misses   int64 // 未命中次数
+	Size     int64 // 当前缓存的字节数
+	Capacity int64 // 容量 (字节), 为 0 时表示没有启用块缓存
+}
+
+// HitRate 获取命中率, 没有访问过时返回 0
+func (s CacheStats) HitRate() float64 {
+	if s.Hits+s.Misses == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(s.Hits+s.Misses)
+}
+
+// CacheStats 获取块缓存的统计信息
+func (tt *TablesTree) CacheStats() CacheStats {
+	c := tt.cache
+	if c == nil {
+		return CacheStats{}
+	}
+	stats := CacheStats{Hits: c.hits.Load(), Misses: c.misses.Load()}
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.Lock()
+		stats.Size += s.size
+		stats.Capacity += s.capacity
+		s.Unlock()
+	}
+	return stats
+}
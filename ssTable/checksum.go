@@ -0,0 +1,121 @@
+package ssTable
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+)
+
+/*
+从版本 4 开始, 每个块 (数据块、索引区、过滤器块) 之后紧跟 4 字节的 CRC32C, 块的长度不包括它
+文件末尾的 MetaInfo 格式为
+┌───────────────────────────────────────────┬─────────┬────────────┬───────────┐
+│ 各字段 (int64), 见 encodeFooter            │ version │ CRC32C (4) │ magic (8) │
+└───────────────────────────────────────────┴─────────┴────────────┴───────────┘
+CRC32C 覆盖它之前的所有字段, magic 用于区分旧版本没有校验的 MetaInfo
+*/
+
+const (
+	tableMagic  = 0x716c736d53535431 // "qlsmSST1"
+	footerTail  = 8 + 4 + 8          // version, CRC32C, magic
+	checksumLen = 4                  // 块之后的 CRC32C 长度
+)
+
+// 获取对应版本的 MetaInfo 长度, 版本 5 增加了属性块的位置和长度, 版本 7 增加了索引分区的数量
+func footerSize(version int64) int64 {
+	if version >= versionPartition {
+		return 8*9 + footerTail
+	}
+	if version >= versionProperties {
+		return 8*8 + footerTail
+	}
+	return 8*6 + footerTail
+}
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// ErrCorruption 表示 SsTable 文件已损坏, 具体的文件和位置见 CorruptionError
+var ErrCorruption = errors.New("ssTable: corruption")
+
+// CorruptionError 描述 SsTable 文件中损坏的位置, errors.Is(err, ErrCorruption) 为 true
+type CorruptionError struct {
+	File   string // 文件路径
+	Offset int64  // 损坏的数据在文件中的位置
+	Reason string
+}
+
+func (e *CorruptionError) Error() string {
+	return fmt.Sprintf("ssTable: corruption in %s at offset %d: %s", e.File, e.Offset, e.Reason)
+}
+
+func (e *CorruptionError) Is(target error) bool {
+	return target == ErrCorruption
+}
+
+// 编码版本 4 及之后的 MetaInfo
+func encodeFooter(m MetaInfo) []byte {
+	buf := make([]byte, 0, footerSize(m.version))
+	fields := []int64{m.dataStart, m.dataLen, m.indexStart, m.indexLen, m.filterStart, m.filterLen}
+	if m.version >= versionProperties {
+		fields = append(fields, m.propsStart, m.propsLen)
+	}
+	if m.version >= versionPartition {
+		fields = append(fields, m.partitions)
+	}
+	for _, v := range append(fields, m.version) {
+		buf = binary.LittleEndian.AppendUint64(buf, uint64(v))
+	}
+	buf = binary.LittleEndian.AppendUint32(buf, crc32.Checksum(buf, crcTable))
+	return binary.LittleEndian.AppendUint64(buf, tableMagic)
+}
+
+// 解码版本 4 及之后的 MetaInfo, buf 为文件末尾的 footerSize(version) 个字节
+func decodeFooter(buf []byte) (MetaInfo, error) {
+	body := buf[:len(buf)-footerTail+8]
+	if crc32.Checksum(body, crcTable) != binary.LittleEndian.Uint32(buf[len(body):]) {
+		return MetaInfo{}, errors.New("footer checksum mismatch")
+	}
+	fields := make([]int64, len(body)/8)
+	for i := range fields {
+		fields[i] = int64(binary.LittleEndian.Uint64(body[i*8:]))
+	}
+	m := MetaInfo{
+		dataStart:   fields[0],
+		dataLen:     fields[1],
+		indexStart:  fields[2],
+		indexLen:    fields[3],
+		filterStart: fields[4],
+		filterLen:   fields[5],
+		version:     fields[len(fields)-1],
+	}
+	if m.version >= versionProperties {
+		m.propsStart, m.propsLen = fields[6], fields[7]
+	}
+	if m.version >= versionPartition {
+		m.partitions = fields[8]
+	}
+	return m, nil
+}
+
+// blockWriter 顺序写入块, 每个块之后写入它的 CRC32C
+type blockWriter struct {
+	w      *bufio.Writer
+	offset int64 // 下一个块的位置
+}
+
+// 写入一个块, 返回它的位置和长度 (不包括 CRC32C)
+func (bw *blockWriter) writeBlock(block []byte) (int64, int64, error) {
+	offset := bw.offset
+	if _, err := bw.w.Write(block); err != nil {
+		return 0, 0, err
+	}
+	var crc [checksumLen]byte
+	binary.LittleEndian.PutUint32(crc[:], crc32.Checksum(block, crcTable))
+	if _, err := bw.w.Write(crc[:]); err != nil {
+		return 0, 0, err
+	}
+	bw.offset += int64(len(block)) + checksumLen
+	return offset, int64(len(block)), nil
+}
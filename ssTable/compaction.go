@@ -1,111 +1,189 @@
 package ssTable
 
 import (
-	"encoding/json"
 	"log"
-	"os"
+	"math"
 	"qlsm/config"
 	"qlsm/kv"
+	"qlsm/memTable"
 	"qlsm/memTable/skiplist"
 	"time"
 )
 
-// Compaction 对 SsTable 进行压实
+// 获取配置的 SsTable 层数, 为 0 时使用 7
+func numLevels() int {
+	if n := config.GetConfig().NumLevels; n > 0 {
+		return n
+	}
+	return 7
+}
+
+// 获取配置的相邻两层大小上限的倍数, 为 0 时使用 4
+func levelMultiplier() int64 {
+	if m := config.GetConfig().LevelSizeMultiplier; m > 0 {
+		return int64(m)
+	}
+	return 4
+}
+
+// 计算 v 中各层 SsTable 文件总大小的上限 (字节), 最后一层没有上限
+// 第 0 层的上限为 Level0Size, 其它层的上限从 Level0Size 开始逐层乘以倍数
+// DynamicLevelBytes 为 true 且最后一层已经超过倒数第二层的上限时, 中间各层的上限改为由最后一层的实际大小逐层除以倍数得到
+// 最后一层较小时仍使用上面的上限, 否则中间各层的上限都是 Level0Size, 每次落盘都会逐层压实到最后一层
+func (v *version) levelTargets() []int64 {
+	base := int64(config.GetConfig().Level0Size) << 20
+	mult := levelMultiplier()
+	last := len(v.levels) - 1
+	targets := make([]int64, len(v.levels))
+	targets[0] = base
+	for i := 1; i < last; i++ {
+		if targets[i-1] > math.MaxInt64/mult {
+			targets[i] = math.MaxInt64
+		} else {
+			targets[i] = targets[i-1] * mult
+		}
+	}
+	if size := v.levelSize(last); config.GetConfig().DynamicLevelBytes && last > 1 && size > targets[last-1] {
+		for i := last - 1; i > 0; i-- {
+			size /= mult
+			if size < base {
+				size = base
+			}
+			targets[i] = size
+		}
+	}
+	targets[last] = math.MaxInt64
+	return targets
+}
+
+// Compaction 对 SsTable 进行压实, 压实被 PauseCompaction 暂停时直接返回
 func (tt *TablesTree) Compaction() {
+	if !tt.compaction.TryLock() {
+		return
+	}
+	defer tt.compaction.Unlock()
 	cfg := config.GetConfig()
-	for levelIndex := range tt.levels {
-		// 转为 MB
-		tableSize := int(tt.getLevelSize(levelIndex) >> 20)
-		// 如果 db 文件数量 > PartSize 或者 db 文件总大小 > levelMaxSize, 触发对应层的 compaction
-		if tt.getCount(levelIndex) >= cfg.PartSize || tableSize >= levelMaxSize[levelIndex] {
-			log.Printf("compress level %d Sstables, the tableSize is %d MB", levelIndex, tableSize)
+	levels := numLevels()
+	for levelIndex := 0; levelIndex < levels; levelIndex++ {
+		// 上一层的压实会修改这一层, 每一层都检查最新的 version
+		v := tt.ref()
+		count := len(v.levels[levelIndex])
+		tableSize := v.levelSize(levelIndex)
+		target := v.levelTargets()[levelIndex]
+		v.unref()
+		// 如果 db 文件数量 >= PartSize 或者 db 文件总大小 >= 该层的上限, 触发对应层的 compaction
+		trigger := count > 0 && (count >= cfg.PartSize || tableSize >= target)
+		if levelIndex == levels-1 {
+			// 最后一层没有大小上限, 压实到自身, 只有一个 SsTable 时压实不会减少文件数量, 至少需要 2 个
+			trigger = count >= 2 && count >= cfg.PartSize
+		}
+		if trigger {
+			log.Printf("compress level %d Sstables, the tableSize is %d MB", levelIndex, tableSize>>20)
 			tt.majorCompactionLevel(levelIndex)
 		}
 	}
 }
 
-// 压缩当前层的文件到下一层, 只能被 Compaction() 调用
+// 压缩当前层的文件到下一层, 最后一层压缩到自身, 只能被 Compaction() 调用
 func (tt *TablesTree) majorCompactionLevel(level int) {
 	start := time.Now()
 	defer func() {
 		log.Println("completed compressing, consumption of time", time.Since(start))
 	}()
 
-	curr := tt.levels[level]
+	// 持有开始时的 version, 读取期间不阻塞查找, 被合并的 SsTable 也不会被删除
+	v := tt.ref()
+	defer v.unref()
 	// 将当前层的 SsTable 合并到一个 MemTable 中
 	mt := skiplist.New()
-	tt.Lock()
-	for curr != nil {
-		t := curr.table
-		data := make([]byte, t.metaInfo.dataLen)
-		// 读取 SsTable 的数据区
-		if _, err := t.f.Seek(0, 0); err != nil {
-			log.Println("fail to open file", t.filepath)
-			panic(err)
-		}
-		if _, err := t.f.Read(data); err != nil {
-			log.Println("fail to read file", t.filepath)
-			panic(err)
+	// 输出的序列号范围覆盖所有输入, 有输入没有属性时未知
+	var seqs SeqRange
+	known := true
+	// 被合并的 SsTable, 与新的 SsTable 在同一次修改中删除
+	var inputs []tableFile
+	for _, curr := range v.levels[level] {
+		inputs = append(inputs, tableFile{level: level, index: curr.index})
+		if props, ok := curr.table.Properties(); ok && props.MinSeq > 0 {
+			if seqs.Min == 0 || props.MinSeq < seqs.Min {
+				seqs.Min = props.MinSeq
+			}
+			if props.MaxSeq > seqs.Max {
+				seqs.Max = props.MaxSeq
+			}
+		} else if !ok || props.Entries > 0 {
+			known = false
 		}
 		// 读取每一个元素
-		for k, p := range t.sparseIndex {
-			if !p.Deleted {
-				var value kv.Data
-				if err := json.Unmarshal(data[p.Start:(p.Start+p.Len)], &value); err != nil {
-					log.Fatal(err)
-				}
-				mt.Set(k, value.Value)
+		err := curr.table.scan(func(value kv.Data) {
+			if value.Deleted {
+				mt.Delete(value.Key)
 			} else {
-				mt.Delete(k)
+				mt.Set(value.Key, value.Value)
 			}
+		})
+		if err != nil {
+			log.Println("fail to read file", curr.table.filepath)
+			panic(err)
 		}
-		curr = curr.next
 	}
-	tt.Unlock()
 	// 将 MemTable 压缩合并成一个 SsTable
-	values := mt.GetValues()
-	// 最多支持 10 层, 不过也不可能到达
+	last := len(v.levels) - 1
 	newLevel := level + 1
-	if newLevel > 10 {
-		newLevel = 10
+	if newLevel > last {
+		newLevel = last
+	}
+	var it memTable.Iterator = mt.NewIterator()
+	// 输出到最后一层且其中没有更旧的数据时, 墓碑已经没有要覆盖的数据, 直接丢弃
+	// 压实期间导入被暂停, 落盘只会写入第 0 层, 最后一层不会出现更旧的数据
+	if newLevel == last && (newLevel == level || len(v.levels[last]) == 0) {
+		it = &liveIterator{Iterator: it}
+	}
+	it.SeekToFirst()
+	if !it.Valid() {
+		// 所有元素都被删除了, 只删除被合并的 SsTable
+		tt.logAndApply(versionEdit{deleted: inputs})
+		log.Printf("level %d Sstables are all deleted\n", level)
+		return
 	}
 	// 创建新的 SsTable
-	tt.CreateTable(values, newLevel)
-	// 重置该层
-	if level < 10 {
-		tt.clearLevel(level)
+	if !known {
+		seqs = SeqRange{}
 	}
+	table, index := tt.buildTable(it, newLevel, seqs)
+	// 新的 SsTable 和被合并的 SsTable 在 MANIFEST 中的同一条记录中替换, 崩溃后不会同时存在
+	tt.logAndApply(versionEdit{
+		added:   []tableFile{{level: newLevel, index: index, table: table}},
+		deleted: inputs,
+	})
+	log.Printf("create a new SsTable, level: %d, index: %d\n", newLevel, index)
 }
 
-func (tt *TablesTree) getCount(level int) int {
-	curr := tt.levels[level]
-	count := 0
-	for curr != nil {
-		count++
-		curr = curr.next
-	}
-	return count
+// liveIterator 跳过 Iterator 中的墓碑
+type liveIterator struct {
+	memTable.Iterator
 }
 
-func (tt *TablesTree) clearLevel(level int) {
-	tt.Lock()
-	defer tt.Unlock()
-	oldNode := tt.levels[level]
-	// 清理当前层所有 SsTable
-	for oldNode != nil {
-		oldNode.table.Lock()
-		if err := oldNode.table.f.Close(); err != nil {
-			log.Println("fail to close file", oldNode.table.filepath)
-			panic(err)
-		}
-		if err := os.Remove(oldNode.table.filepath); err != nil {
-			log.Println("fail to delete file", oldNode.table.filepath)
-			panic(err)
-		}
-		oldNode.table.Unlock()
-		oldNode.table.f = nil
-		oldNode.table = nil
-		oldNode = oldNode.next
+// Seek 定位到第一个 key 不小于给定 key 的存活元素
+func (it *liveIterator) Seek(key string) {
+	it.Iterator.Seek(key)
+	it.skip()
+}
+
+// SeekToFirst 定位到第一个存活元素
+func (it *liveIterator) SeekToFirst() {
+	it.Iterator.SeekToFirst()
+	it.skip()
+}
+
+// Next 移动到下一个存活元素
+func (it *liveIterator) Next() {
+	it.Iterator.Next()
+	it.skip()
+}
+
+// 跳过墓碑
+func (it *liveIterator) skip() {
+	for it.Iterator.Valid() && it.Iterator.Entry().Deleted {
+		it.Iterator.Next()
 	}
-	tt.levels[level] = nil
 }
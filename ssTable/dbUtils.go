@@ -1,10 +1,14 @@
 package ssTable
 
 import (
-	"encoding/binary"
+	"bufio"
 	"fmt"
+	"io"
 	"log"
 	"os"
+	"path"
+	"qlsm/kv"
+	"qlsm/memTable"
 )
 
 // 获取 db 对应的 level 和 index 信息
@@ -16,56 +20,227 @@ func getSsTableInfo(filename string) (level int, index int, err error) {
 	return level, index, nil
 }
 
-// 获取 db 数据文件大小
+// 获取 db 数据文件大小, 使用打开文件时记录的大小, 文件写入后不再修改, 已被删除的文件也可以获取
 func (t *SsTable) getDBSize() int64 {
-	info, err := os.Stat(t.filepath)
+	return t.size
+}
+
+// 将 it 中的元素按顺序切分成数据块, 按 <data, sparseIndex, filter, properties, metaInfo> 写入 db 文件
+// 数据块使用 props.Codec 压缩, 每个块之后都有 CRC32C, props 中与内容有关的字段在写入时统计
+// 返回稀疏索引、过滤器、属性和元数据
+func writeDataToFile(filepath string, it memTable.Iterator, props Properties) ([]blockHandle, []byte, Properties, MetaInfo) {
+	b, err := newTableBuilder(filepath, props)
+	if err != nil {
+		log.Fatal("fail to create file:", err)
+	}
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		if err = b.add(it.Entry()); err != nil {
+			log.Fatal("fail to write dataArea:", err)
+		}
+	}
+	index, filter, metaInfo, err := b.finish()
 	if err != nil {
-		log.Fatal(err)
+		log.Fatal("fail to write .db:", err)
 	}
-	return info.Size()
+	return index, filter, b.props, metaInfo
 }
 
-// 获取指定层的 SsTable 总文件大小
-func (tt *TablesTree) getLevelSize(level int) (size int64) {
-	curr := tt.levels[level]
-	for curr != nil {
-		size += curr.table.getDBSize()
-		curr = curr.next
+// tableBuilder 将按 key 排好序的元素流式写入一个新的 db 文件, 数据块写满后立即写入文件
+type tableBuilder struct {
+	f          *os.File
+	w          *bufio.Writer
+	bw         *blockWriter
+	index      []blockHandle
+	block      blockBuilder
+	stored     []byte // 压缩后的数据块
+	hashes     []uint64
+	size       int
+	bitsPerKey int
+	props      Properties
+}
+
+// 创建 filepath 并开始写入, props 中与内容无关的字段会原样写入属性块
+func newTableBuilder(filepath string, props Properties) (*tableBuilder, error) {
+	f, err := os.OpenFile(filepath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return nil, err
 	}
-	return size
+	w := bufio.NewWriterSize(f, 1<<20)
+	return &tableBuilder{
+		f:          f,
+		w:          w,
+		bw:         &blockWriter{w: w},
+		block:      blockBuilder{interval: restartInterval()},
+		size:       blockSize(),
+		bitsPerKey: bloomBitsPerKey(),
+		props:      props,
+	}, nil
 }
 
-// 将数据按顺序 <data, sparseIndex, metaInfo> 写入 db 文件
-func writeDataToFile(filepath string, dataArea []byte, indexArea []byte, metaInfo MetaInfo) {
-	f, err := os.OpenFile(filepath, os.O_WRONLY|os.O_CREATE, 0666)
+// 追加一个元素, 元素需要按 key 的顺序追加
+func (b *tableBuilder) add(entry kv.Data) error {
+	b.block.add(entry)
+	b.props.add(entry)
+	if b.bitsPerKey > 0 {
+		b.hashes = append(b.hashes, bloomHash(entry.Key))
+	}
+	if b.block.size() >= b.size {
+		return b.finishBlock()
+	}
+	return nil
+}
+
+// 压缩并写入当前的数据块
+func (b *tableBuilder) finishBlock() error {
+	if b.block.empty() {
+		return nil
+	}
+	stored, err := compressBlock(b.stored[:0], b.block.finish(), b.props.Codec)
 	if err != nil {
-		log.Fatal("fail to create file:", err)
+		return err
+	}
+	b.stored = stored
+	offset, length, err := b.bw.writeBlock(b.stored)
+	if err != nil {
+		return err
+	}
+	b.index = append(b.index, blockHandle{lastKey: b.block.lastKey, offset: offset, length: length})
+	b.block.reset()
+	return nil
+}
+
+// 写入剩余的数据块、稀疏索引、过滤器、属性和元数据, 然后落盘并关闭文件, 稀疏索引分区时返回顶层索引
+func (b *tableBuilder) finish() (index []blockHandle, filter []byte, metaInfo MetaInfo, err error) {
+	defer func() {
+		if err != nil {
+			_ = b.f.Close()
+		}
+	}()
+	if err = b.finishBlock(); err != nil {
+		return nil, nil, metaInfo, err
+	}
+	metaInfo = MetaInfo{version: versionPartition, dataStart: 0, dataLen: b.bw.offset}
+
+	// 稀疏索引超过分区大小时先写入各个分区, 稀疏索引区只保存指向分区的顶层索引
+	index = b.index
+	if size := indexPartitionSize(); size > 0 && len(encodeIndex(index)) > size {
+		var top []blockHandle
+		for _, part := range partitionIndex(index, size) {
+			offset, length, err := b.bw.writeBlock(encodeIndex(part))
+			if err != nil {
+				return nil, nil, metaInfo, err
+			}
+			top = append(top, blockHandle{lastKey: part[len(part)-1].lastKey, offset: offset, length: length})
+		}
+		index = top
+		metaInfo.partitions = int64(len(top))
+	}
+
+	// 生成稀疏索引区
+	metaInfo.indexStart, metaInfo.indexLen, err = b.bw.writeBlock(encodeIndex(index))
+	if err != nil {
+		return nil, nil, metaInfo, err
+	}
+
+	// 生成过滤器块
+	if b.bitsPerKey > 0 {
+		filter = buildFilter(b.hashes, b.bitsPerKey)
+		metaInfo.filterStart, metaInfo.filterLen, err = b.bw.writeBlock(filter)
+		if err != nil {
+			return nil, nil, metaInfo, err
+		}
 	}
-	if _, err = f.Write(dataArea); err != nil {
-		log.Fatal("fail to write dataArea:", err)
+
+	// 生成属性块
+	metaInfo.propsStart, metaInfo.propsLen, err = b.bw.writeBlock(encodeProperties(b.props))
+	if err != nil {
+		return nil, nil, metaInfo, err
 	}
-	if _, err = f.Write(indexArea); err != nil {
-		log.Fatal("fail to write indexArea:", err)
+
+	if _, err = b.w.Write(encodeFooter(metaInfo)); err != nil {
+		return nil, nil, metaInfo, err
 	}
-	if err = binary.Write(f, binary.LittleEndian, &metaInfo.version); err != nil {
-		log.Fatal("fail to write metaInfo.version:", err)
+	if err = b.w.Flush(); err != nil {
+		return nil, nil, metaInfo, err
 	}
-	if err = binary.Write(f, binary.LittleEndian, &metaInfo.dataStart); err != nil {
-		log.Fatal("fail to write metaInfo.dataStart:", err)
+	if err = b.f.Sync(); err != nil {
+		return nil, nil, metaInfo, err
 	}
-	if err = binary.Write(f, binary.LittleEndian, &metaInfo.dataLen); err != nil {
-		log.Fatal("fail to write metaInfo.dataLen:", err)
+	if err = b.f.Close(); err != nil {
+		return nil, nil, metaInfo, err
 	}
-	if err = binary.Write(f, binary.LittleEndian, &metaInfo.indexStart); err != nil {
-		log.Fatal("fail to write metaInfo.indexStart:", err)
+	syncDir(path.Dir(b.f.Name()))
+	return index, filter, metaInfo, nil
+}
+
+// 放弃写入并删除文件
+func (b *tableBuilder) abort() {
+	_ = b.f.Close()
+	_ = os.Remove(b.f.Name())
+}
+
+// 将目录落盘, 保证新建的 db 文件在崩溃后依然可见
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		log.Fatal("fail to open the directory:", err)
 	}
-	if err = binary.Write(f, binary.LittleEndian, &metaInfo.indexLen); err != nil {
-		log.Fatal("fail to write metaInfo.indexLen:", err)
+	defer d.Close()
+	if err = d.Sync(); err != nil {
+		log.Fatal("fail to sync the directory:", err)
+	}
+}
+
+// Backup 将所有 SsTable 链接 (或复制) 到 dir 中, SsTable 写入后不再修改, 因此可以直接硬链接
+// 同时在 dir 中写入只包含这些 SsTable 的 MANIFEST
+func (tt *TablesTree) Backup(dir string) error {
+	// 备份期间持有当前的 version, 其中的 SsTable 不会被删除
+	v := tt.ref()
+	defer v.unref()
+	tt.RLock()
+	nextIndex := tt.nextIndex
+	tt.RUnlock()
+	for _, nodes := range v.levels {
+		for _, curr := range nodes {
+			dst := path.Join(dir, path.Base(curr.table.filepath))
+			// 之前的备份中的同名文件可能是同一个文件的硬链接, 直接覆盖写入会截断原文件
+			if err := os.Remove(dst); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			if err := os.Link(curr.table.filepath, dst); err == nil {
+				continue
+			}
+			if err := copyFile(curr.table.filepath, dst); err != nil {
+				return err
+			}
+		}
+	}
+	// 文件编号 nextIndex 还没有被使用, 恢复后的数据库会从它之后继续分配
+	f, _, err := writeManifest(dir, nextIndex, v.snapshot(nextIndex))
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// 将 src 复制到 dst 并落盘
+func copyFile(src string, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
 	}
-	if err = f.Sync(); err != nil {
-		log.Fatal("fail to write metaInfo:", err)
+	if _, err = io.Copy(out, in); err != nil {
+		_ = out.Close()
+		return err
 	}
-	if err = f.Close(); err != nil {
-		log.Fatal("fail to close .db:", err)
+	if err = out.Sync(); err != nil {
+		_ = out.Close()
+		return err
 	}
+	return out.Close()
 }
@@ -0,0 +1,109 @@
+package ssTable
+
+import (
+	"qlsm/config"
+	"sync/atomic"
+)
+
+/*
+Bloom 过滤器使用双重哈希, 由 key 的 64 位 FNV-1a 哈希拆出两个 32 位哈希 h1, h2
+第 i 个探测位为 (h1 + i*h2) % bits, 过滤器块的格式为
+┌────────────────┬──────────────┐
+│      bits      │  probes (1)  │
+└────────────────┴──────────────┘
+*/
+
+const defaultBloomBitsPerKey = 10 // 默认每个 key 占用的位数, 假阳性率约为 1%
+
+// 获取配置的每个 key 占用的位数, 为 0 时不生成过滤器
+func bloomBitsPerKey() int {
+	bitsPerKey := config.GetConfig().BloomBitsPerKey
+	if bitsPerKey == 0 {
+		return defaultBloomBitsPerKey
+	}
+	if bitsPerKey < 0 {
+		return 0
+	}
+	return bitsPerKey
+}
+
+// 计算 key 的 64 位 FNV-1a 哈希
+func bloomHash(key string) uint64 {
+	h := uint64(14695981039346656037)
+	for i := 0; i < len(key); i++ {
+		h ^= uint64(key[i])
+		h *= 1099511628211
+	}
+	return h
+}
+
+// 由 key 的哈希生成过滤器块
+func buildFilter(hashes []uint64, bitsPerKey int) []byte {
+	// 探测次数取 bitsPerKey * ln2 时假阳性率最低
+	probes := bitsPerKey * 69 / 100
+	if probes < 1 {
+		probes = 1
+	}
+	if probes > 30 {
+		probes = 30
+	}
+	bits := len(hashes) * bitsPerKey
+	// key 很少时假阳性率会很高, 设置一个最小长度
+	if bits < 64 {
+		bits = 64
+	}
+	bytes := (bits + 7) / 8
+	bits = bytes * 8
+
+	filter := make([]byte, bytes+1)
+	for _, h := range hashes {
+		h1, h2 := uint32(h), uint32(h>>32)
+		for i := 0; i < probes; i++ {
+			pos := (h1 + uint32(i)*h2) % uint32(bits)
+			filter[pos/8] |= 1 << (pos % 8)
+		}
+	}
+	filter[bytes] = byte(probes)
+	return filter
+}
+
+// 判断 key 是否可能在过滤器中, 返回 false 时 key 一定不存在
+func filterMayContain(filter []byte, key string) bool {
+	if len(filter) < 2 {
+		return true
+	}
+	bits := uint32(len(filter)-1) * 8
+	probes := int(filter[len(filter)-1])
+	h := bloomHash(key)
+	h1, h2 := uint32(h), uint32(h>>32)
+	for i := 0; i < probes; i++ {
+		pos := (h1 + uint32(i)*h2) % bits
+		if filter[pos/8]&(1<<(pos%8)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// FilterStats 是 Bloom 过滤器的统计信息
+type FilterStats struct {
+	Checks int64 // 查询过滤器的次数
+	Hits   int64 // 过滤器判定 key 不存在, 省去读取 SsTable 的次数
+	Misses int64 // 过滤器判定 key 可能存在, 但 SsTable 中没有该 key 的次数 (假阳性)
+}
+
+// filterCounters 记录 TablesTree 中所有过滤器的统计信息
+type filterCounters struct {
+	checks atomic.Int64
+	hits   atomic.Int64
+	misses atomic.Int64
+}
+
+// FilterStats 获取 Bloom 过滤器的统计信息
+func (tt *TablesTree) FilterStats() FilterStats {
+	return FilterStats{
+		Checks: tt.filterCounters.checks.Load(),
+		Hits:   tt.filterCounters.hits.Load(),
+		Misses: tt.filterCounters.misses.Load(),
+	}
+}
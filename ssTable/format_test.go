@@ -0,0 +1,137 @@
+package ssTable
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"qlsm/codec"
+	"qlsm/kv"
+	"testing"
+)
+
+/*
+testdata 中的 vN.db 是版本 N 的代码写入的 SsTable, 内容相同:
+key0000 到 key0299, 每 10 个 key 中的第一个只有墓碑, 其余的值为 JSON 编码的 "value<i>"
+版本 3 使用 flate, 版本 4 使用 lz, 版本 5 使用 zlib 压缩数据块, 其余不压缩
+*/
+
+const fixtureKeys = 300
+
+func fixtureEntry(i int) kv.Data {
+	key := fmt.Sprintf("key%04d", i)
+	if i%10 == 0 {
+		return kv.Data{Key: key, Deleted: true}
+	}
+	value, _ := json.Marshal(fmt.Sprintf("value%d", i))
+	return kv.Data{Key: key, Value: value}
+}
+
+// 检查 r 中的内容与 fixtureEntry 一致
+func checkFixture(t *testing.T, r *SstReader) {
+	t.Helper()
+	if err := r.VerifyChecksums(); err != nil {
+		t.Fatalf("VerifyChecksums: %v", err)
+	}
+	it := r.NewIterator(true)
+	n := 0
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		if want := fixtureEntry(n); !sameEntry(it.Entry(), want) {
+			t.Fatalf("entry %d is %+v, want %+v", n, it.Entry(), want)
+		}
+		n++
+	}
+	if it.Error() != nil || n != fixtureKeys {
+		t.Fatalf("iterated %d entries, err %v", n, it.Error())
+	}
+	// 查找存在的 key、墓碑、两个 key 之间、第一个 key 之前和最后一个 key 之后
+	for i := 0; i < fixtureKeys; i++ {
+		want := fixtureEntry(i)
+		got, result, err := r.Get(want.Key)
+		if err != nil {
+			t.Fatalf("Get(%s): %v", want.Key, err)
+		}
+		if want.Deleted {
+			if result != kv.Deleted {
+				t.Fatalf("Get(%s) = %v, want Deleted", want.Key, result)
+			}
+		} else if result != kv.Success || string(got.Value) != string(want.Value) {
+			t.Fatalf("Get(%s) = %q %v, want %q", want.Key, got.Value, result, want.Value)
+		}
+	}
+	for _, key := range []string{"key", "key0001a", "key0299a", "a", "z"} {
+		if _, result, err := r.Get(key); result != kv.None || err != nil {
+			t.Fatalf("Get(%s) = %v %v, want None", key, result, err)
+		}
+	}
+	it = r.NewIterator(false)
+	it.Seek("key0009a")
+	if !it.Valid() || it.Entry().Key != "key0011" {
+		t.Fatalf("Seek(key0009a) skipping tombstones should stop at key0011, got %+v", it.Entry())
+	}
+}
+
+// 旧版本的文件仍然可以读取
+func TestOldFormats(t *testing.T) {
+	for version := versionJSON; version < versionPartition; version++ {
+		t.Run(fmt.Sprintf("v%d", version), func(t *testing.T) {
+			r, err := OpenSstReader(filepath.Join("testdata", fmt.Sprintf("v%d.db", version)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer r.Close()
+			if r.Version() != int64(version) {
+				t.Fatalf("the file has version %d, want %d", r.Version(), version)
+			}
+			if _, ok := r.Properties(); ok != (version >= versionProperties) {
+				t.Fatalf("Properties() returned %v for version %d", ok, version)
+			}
+			checkFixture(t, r)
+		})
+	}
+}
+
+// 当前版本写入的文件有多个数据块和索引分区
+func TestCurrentFormat(t *testing.T) {
+	for _, c := range []codec.Codec{codec.None, codec.Flate, codec.LZ} {
+		t.Run(c.String(), func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "table.db")
+			w, err := NewSstWriter(path, c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < fixtureKeys; i++ {
+				e := fixtureEntry(i)
+				if e.Deleted {
+					err = w.Delete(e.Key)
+				} else {
+					err = w.Put(e.Key, e.Value)
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			if _, err = w.Finish(); err != nil {
+				t.Fatal(err)
+			}
+			r, err := OpenSstReader(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer r.Close()
+			if r.Version() != versionPartition || r.t.metaInfo.partitions < 2 {
+				t.Fatalf("the file has version %d and %d index partitions", r.Version(), r.t.metaInfo.partitions)
+			}
+			props, ok := r.Properties()
+			if !ok || props.Entries != fixtureKeys || props.Tombstones != fixtureKeys/10 {
+				t.Fatalf("Properties() = %+v %v", props, ok)
+			}
+			checkFixture(t, r)
+		})
+	}
+}
+
+func TestSstWriterRejectsUnknownCodec(t *testing.T) {
+	if _, err := NewSstWriter(filepath.Join(t.TempDir(), "table.db"), codec.Codec(200)); err == nil {
+		t.Fatal("NewSstWriter should reject an unknown codec")
+	}
+}
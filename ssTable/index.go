@@ -0,0 +1,126 @@
+package ssTable
+
+import (
+	"qlsm/config"
+	"sort"
+)
+
+/*
+从版本 7 开始, 稀疏索引超过 IndexPartitionSize 时被拆分为多个分区, 文件格式为
+┌──────────┬─────────────┬─────┬─────────────┬──────────┬─────────────────────────┐
+│   Data   │ Partition 0 │ ... │ Partition n │ TopIndex │ Filter, Props, MetaInfo │
+└──────────┴─────────────┴─────┴─────────────┴──────────┴─────────────────────────┘
+每个分区和顶层索引都是索引区的格式, 见 block.go, 分区的条目指向数据块, 顶层索引的条目指向分区
+顶层索引条目的 lastKey 是分区中最大的 key, MetaInfo 中的 indexStart 和 indexLen 指向顶层索引
+打开文件时只加载顶层索引, 分区在查找时通过块缓存按需加载
+*/
+
+// 获取配置的索引分区大小, 为 0 时不分区
+func indexPartitionSize() int {
+	return config.GetConfig().IndexPartitionSize
+}
+
+// 将稀疏索引按 size 拆分为多个分区, 每个分区编码后不小于 size (最后一个分区除外)
+func partitionIndex(index []blockHandle, size int) [][]blockHandle {
+	var parts [][]blockHandle
+	start, n := 0, 0
+	for i := range index {
+		n += len(encodeIndex(index[i : i+1]))
+		if n >= size {
+			parts = append(parts, index[start:i+1])
+			start, n = i+1, 0
+		}
+	}
+	if start < len(index) {
+		parts = append(parts, index[start:])
+	}
+	return parts
+}
+
+// 读取一个索引分区, 先从块缓存中查找, 读到的分区会加入块缓存
+func (t *SsTable) readPartition(h blockHandle) ([]blockHandle, error) {
+	key := cacheKey{number: t.number, offset: h.offset}
+	if v, ok := t.cache.get(key); ok {
+		return v.([]blockHandle), nil
+	}
+	bs, err := t.readBlockAt(h.offset, h.length)
+	if err != nil {
+		return nil, err
+	}
+	part, err := decodeIndex(bs)
+	if err != nil {
+		return nil, t.corruption(h.offset, err.Error())
+	}
+	t.cache.put(key, part, h.length+int64(len(part))*blockHandleSize)
+	return part, nil
+}
+
+// indexIter 按顺序遍历版本 1 及之后的 SsTable 的数据块, 稀疏索引分区时只在需要时读取分区
+type indexIter struct {
+	t      *SsTable
+	top    []blockHandle // 分区时为顶层索引, 否则为 nil
+	part   int           // 当前分区在顶层索引中的位置
+	blocks []blockHandle // 当前分区中 (不分区时为全部) 的数据块
+	i      int           // 当前数据块在 blocks 中的位置
+	err    error
+}
+
+// 创建一个位于第一个数据块之前的 indexIter
+func (t *SsTable) newIndexIter() (*indexIter, error) {
+	index, err := t.getIndex()
+	if err != nil {
+		return nil, err
+	}
+	if t.metaInfo.partitions == 0 {
+		return &indexIter{t: t, blocks: index, i: -1}, nil
+	}
+	return &indexIter{t: t, top: index, part: -1, i: -1}, nil
+}
+
+// 定位到第一个最大 key 不小于 key 的数据块, 没有这样的数据块或出错时返回 false
+func (it *indexIter) seek(key string) bool {
+	if it.top != nil {
+		// 分区中最大的 key 不小于 key 时, 分区中一定有满足条件的数据块
+		it.part = sort.Search(len(it.top), func(i int) bool {
+			return it.top[i].lastKey >= key
+		})
+		if !it.loadPartition() {
+			return false
+		}
+	}
+	it.i = sort.Search(len(it.blocks), func(i int) bool {
+		return it.blocks[i].lastKey >= key
+	})
+	return it.i < len(it.blocks)
+}
+
+// 移动到下一个数据块, 没有更多数据块或出错时返回 false
+func (it *indexIter) next() bool {
+	it.i++
+	for it.i >= len(it.blocks) {
+		if it.top == nil {
+			return false
+		}
+		it.part++
+		if !it.loadPartition() {
+			return false
+		}
+		it.i = 0
+	}
+	return true
+}
+
+// 读取当前分区, 超出范围或出错时返回 false
+func (it *indexIter) loadPartition() bool {
+	it.blocks = nil
+	if it.part >= len(it.top) {
+		return false
+	}
+	it.blocks, it.err = it.t.readPartition(it.top[it.part])
+	return it.err == nil
+}
+
+// 当前数据块, 只能在 seek 或 next 返回 true 后调用
+func (it *indexIter) handle() blockHandle {
+	return it.blocks[it.i]
+}
@@ -0,0 +1,235 @@
+package ssTable
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"qlsm/config"
+	"qlsm/kv"
+	"sort"
+	"strconv"
+)
+
+// ingestSuffix 是导入过程中临时文件的后缀, 启动时会删除残留的临时文件
+const ingestSuffix = ".ingest"
+
+// IngestFile 是一个校验过、等待导入的外部 SsTable, 属性块之前的内容已经复制到数据目录中的临时文件
+type IngestFile struct {
+	Props    Properties
+	tmpPath  string
+	metaInfo MetaInfo
+}
+
+// PrepareIngest 校验 paths 中的 SsTable 并复制到 dir 中的临时文件, 返回按 key 范围排序的结果
+// 文件必须带有属性块 (例如由 SstWriter 生成) 且不为空, 所有块的校验和、key 的顺序和范围都会被检查
+// 文件之间的 key 范围不能重叠, 出错时不会留下临时文件
+func PrepareIngest(dir string, paths []string) (files []IngestFile, err error) {
+	defer func() {
+		if err != nil {
+			DiscardIngest(files)
+			files = nil
+		}
+	}()
+	for _, p := range paths {
+		file, err := prepareIngestFile(dir, p)
+		if err != nil {
+			return files, err
+		}
+		files = append(files, file)
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Props.SmallestKey < files[j].Props.SmallestKey
+	})
+	for i := 1; i < len(files); i++ {
+		if files[i].Props.SmallestKey <= files[i-1].Props.LargestKey {
+			return files, fmt.Errorf("ssTable: the key ranges of the ingested files overlap at %q", files[i].Props.SmallestKey)
+		}
+	}
+	return files, nil
+}
+
+// 校验一个外部 SsTable 并复制它属性块之前的内容
+func prepareIngestFile(dir string, filepath string) (IngestFile, error) {
+	t := &SsTable{filepath: filepath}
+	if err := t.open(); err != nil {
+		return IngestFile{}, err
+	}
+	defer t.close()
+	if err := t.loadMetaInfo(); err != nil {
+		return IngestFile{}, err
+	}
+	if t.metaInfo.version < versionProperties {
+		return IngestFile{}, fmt.Errorf("ssTable: %s has no properties block, rewrite it with SstWriter", filepath)
+	}
+	if err := t.loadProperties(); err != nil {
+		return IngestFile{}, err
+	}
+	if t.props.Entries == 0 {
+		return IngestFile{}, fmt.Errorf("ssTable: %s is empty", filepath)
+	}
+	var err error
+	if t.index, err = t.loadIndex(); err != nil {
+		return IngestFile{}, err
+	}
+	// 完整读取所有数据块, 检查校验和以及 key 是否严格递增且与属性一致
+	var entries int64
+	var last string
+	var bad error
+	err = t.scan(func(data kv.Data) {
+		if bad == nil && (entries > 0 && data.Key <= last || data.Key < t.props.SmallestKey || data.Key > t.props.LargestKey) {
+			bad = t.corruption(0, fmt.Sprintf("key %q is out of order or out of the range in the properties", data.Key))
+		}
+		entries++
+		last = data.Key
+	})
+	if err == nil {
+		err = bad
+	}
+	if err == nil && entries != t.props.Entries {
+		err = t.corruption(t.metaInfo.propsStart, fmt.Sprintf("%d entries in the properties, %d in the data", t.props.Entries, entries))
+	}
+	if err != nil {
+		return IngestFile{}, err
+	}
+
+	file := IngestFile{
+		Props:    *t.props,
+		tmpPath:  path.Join(dir, strconv.FormatUint(nextTableNumber.Add(1), 10)+ingestSuffix),
+		metaInfo: t.metaInfo,
+	}
+	out, err := os.OpenFile(file.tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return IngestFile{}, err
+	}
+	if _, err = io.Copy(out, io.NewSectionReader(t.f, 0, t.metaInfo.propsStart)); err != nil {
+		_ = out.Close()
+		_ = os.Remove(file.tmpPath)
+		return IngestFile{}, err
+	}
+	if err = out.Close(); err != nil {
+		_ = os.Remove(file.tmpPath)
+		return IngestFile{}, err
+	}
+	return file, nil
+}
+
+// DiscardIngest 删除 PrepareIngest 生成的临时文件
+func DiscardIngest(files []IngestFile) {
+	for _, file := range files {
+		_ = os.Remove(file.tmpPath)
+	}
+}
+
+// 写入新的属性块和元数据, 完成临时文件
+func (file *IngestFile) finish() error {
+	f, err := os.OpenFile(file.tmpPath, os.O_WRONLY, 0666)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err = f.Seek(file.metaInfo.propsStart, io.SeekStart); err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	bw := &blockWriter{w: w, offset: file.metaInfo.propsStart}
+	file.metaInfo.propsStart, file.metaInfo.propsLen, err = bw.writeBlock(encodeProperties(file.Props))
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(encodeFooter(file.metaInfo)); err != nil {
+		return err
+	}
+	if err = w.Flush(); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// PauseCompaction 等待正在进行的压实完成, 并在 ResumeCompaction 之前跳过压实
+func (tt *TablesTree) PauseCompaction() {
+	tt.compaction.Lock()
+}
+
+// ResumeCompaction 恢复压实, 下一次落盘后会检查是否需要压实
+func (tt *TablesTree) ResumeCompaction() {
+	tt.compaction.Unlock()
+}
+
+// Ingest 将 PrepareIngest 的结果加入 TablesTree, 第 i 个文件的序列号为 seq + i
+// 每个文件放入最低的、key 范围与该层及之上各层都不重叠的层, 与 0 层重叠时作为 0 层最新的 SsTable
+// 所有文件在完成后通过 MANIFEST 中的一条记录一次性加入 TablesTree, 读者要么看到全部文件, 要么一个都看不到
+// 调用者需暂停压实, 并保证 MemTable 中没有与这些文件重叠的数据, 出错时不会留下任何文件
+func (tt *TablesTree) Ingest(files []IngestFile, seq uint64) (err error) {
+	levels := make([]int, len(files))
+	v := tt.ref()
+	for i := range files {
+		levels[i] = v.ingestLevel(files[i].Props.SmallestKey, files[i].Props.LargestKey)
+	}
+	v.unref()
+
+	tables := make([]*SsTable, len(files))
+	added := make([]tableFile, len(files))
+	defer func() {
+		if err == nil {
+			return
+		}
+		DiscardIngest(files)
+		for _, t := range tables {
+			if t != nil {
+				_ = t.close()
+				_ = os.Remove(t.filepath)
+			}
+		}
+	}()
+	dir := config.GetConfig().DataDir
+	for i := range files {
+		file := &files[i]
+		file.Props.MinSeq = seq + uint64(i)
+		file.Props.MaxSeq = seq + uint64(i)
+		file.Props.Level = levels[i]
+		if err = file.finish(); err != nil {
+			return err
+		}
+		added[i] = tableFile{level: levels[i], index: tt.allocIndex()}
+		filePath := tablePath(dir, added[i])
+		if err = os.Rename(file.tmpPath, filePath); err != nil {
+			return err
+		}
+		t := tt.newTable(levels[i])
+		t.filepath = filePath
+		tables[i] = t
+		added[i].table = t
+		if err = t.load(); err != nil {
+			return err
+		}
+	}
+	syncDir(dir)
+
+	tt.logAndApply(versionEdit{added: added, lastSeq: seq + uint64(len(files)) - 1})
+	return nil
+}
+
+// 获取 key 范围为 [smallest, largest] 的 SsTable 应当导入的层
+func (v *version) ingestLevel(smallest string, largest string) int {
+	for level, nodes := range v.levels {
+		for _, curr := range nodes {
+			if curr.table.overlaps(smallest, largest) {
+				if level == 0 {
+					return 0
+				}
+				return level - 1
+			}
+		}
+	}
+	return len(v.levels) - 1
+}
+
+// 判断 SsTable 的 key 范围是否与 [smallest, largest] 重叠, 没有属性的 SsTable 视为重叠
+func (t *SsTable) overlaps(smallest string, largest string) bool {
+	if t.props == nil {
+		return true
+	}
+	return t.props.Entries > 0 && smallest <= t.props.LargestKey && largest >= t.props.SmallestKey
+}
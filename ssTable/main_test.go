@@ -0,0 +1,18 @@
+package ssTable
+
+import (
+	"os"
+	"qlsm/config"
+	"testing"
+)
+
+// 使用较小的数据块和索引分区, 少量元素就能写出多个数据块和分区
+func TestMain(m *testing.M) {
+	config.Init(config.Config{
+		PartSize:             4,
+		BlockSize:            256,
+		BlockRestartInterval: 4,
+		IndexPartitionSize:   64,
+	})
+	os.Exit(m.Run())
+}
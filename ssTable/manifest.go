@@ -0,0 +1,323 @@
+package ssTable
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"sync"
+)
+
+/*
+MANIFEST 记录 TablesTree 的修改历史, 数据目录中的 CURRENT 文件保存当前 MANIFEST 的文件名, 例如 MANIFEST-000012
+MANIFEST 由若干条记录组成, 每条记录是一个 versionEdit, 格式与 Wal 的记录类似
+┌────────┬────────────┬──────────────────────┐
+│ crc(4) │ dataLen(4) │ data (versionEdit)   │
+└────────┴────────────┴──────────────────────┘
+crc 覆盖 crc 之后的所有字节, data 由若干个字段组成, 每个字段以 tag (uvarint) 开头, 之后的值都使用 uvarint 编码
+┌───────────────────────┬────────────────────┬──────────────────────┬─────────────────────────┬───────────────────────┐
+│ tagNextIndex | index  │ tagLastSeq | seq   │ tagWalNumber | number │ tagDeleted | level | index │ tagAdded | level | index │
+└───────────────────────┴────────────────────┴──────────────────────┴─────────────────────────┴───────────────────────┘
+第一条记录是写入 MANIFEST 时 TablesTree 的完整快照, 之后每次落盘、压实和导入各追加一条记录, 落盘后才修改 TablesTree
+启动时依次应用所有完整的记录得到存活的 SsTable, 末尾不完整的记录 (写入时崩溃) 会被忽略, 然后写入一个新的 MANIFEST
+不在 MANIFEST 中的 db 文件是崩溃前没有完成的落盘、压实或导入留下的, 或是已经被删除但还没来得及删除的文件, 启动时会被删除
+*/
+
+const (
+	currentName     = "CURRENT"
+	manifestPrefix  = "MANIFEST-"
+	maxManifestSize = 4 << 20 // MANIFEST 超过该大小时, 下一次修改前会重写为快照
+	manifestHeader  = 8       // 记录的 crc 和 dataLen
+)
+
+const (
+	tagNextIndex = iota + 1
+	tagLastSeq
+	tagWalNumber
+	tagDeleted
+	tagAdded
+)
+
+// tableFile 是 MANIFEST 中的一个 SsTable, 对应文件 level.index.db
+type tableFile struct {
+	level int
+	index int
+	table *SsTable // 新增的 SsTable, 不写入 MANIFEST
+}
+
+// versionEdit 是对 TablesTree 的一次原子的修改, 为 0 的字段表示没有修改
+type versionEdit struct {
+	added     []tableFile
+	deleted   []tableFile
+	nextIndex int    // 下一个文件编号, SsTable 和 MANIFEST 共用
+	lastSeq   uint64 // 已写入 SsTable 的最大序列号
+	walNumber int    // 编号小于它的 Wal 段中的数据都已写入 SsTable, 启动时不再回放
+}
+
+// versionState 是回放 MANIFEST 得到的状态
+type versionState struct {
+	live      map[tableFile]struct{} // 存活的 SsTable, table 字段为 nil
+	nextIndex int
+	lastSeq   uint64
+	walNumber int
+}
+
+// manifest 是正在写入的 MANIFEST, 修改 TablesTree 时持有锁, 保证修改按写入的顺序应用
+type manifest struct {
+	f      *os.File
+	dir    string
+	number int   // 当前 MANIFEST 的编号
+	size   int64 // 当前 MANIFEST 的大小
+	sync.Mutex
+}
+
+// 获取 MANIFEST 的文件名
+func manifestName(number int) string {
+	return fmt.Sprintf("%s%06d", manifestPrefix, number)
+}
+
+// 编码一个 versionEdit
+func encodeEdit(edit versionEdit) []byte {
+	var buf []byte
+	if edit.nextIndex > 0 {
+		buf = binary.AppendUvarint(buf, tagNextIndex)
+		buf = binary.AppendUvarint(buf, uint64(edit.nextIndex))
+	}
+	if edit.lastSeq > 0 {
+		buf = binary.AppendUvarint(buf, tagLastSeq)
+		buf = binary.AppendUvarint(buf, edit.lastSeq)
+	}
+	if edit.walNumber > 0 {
+		buf = binary.AppendUvarint(buf, tagWalNumber)
+		buf = binary.AppendUvarint(buf, uint64(edit.walNumber))
+	}
+	for _, f := range edit.deleted {
+		buf = binary.AppendUvarint(buf, tagDeleted)
+		buf = binary.AppendUvarint(buf, uint64(f.level))
+		buf = binary.AppendUvarint(buf, uint64(f.index))
+	}
+	for _, f := range edit.added {
+		buf = binary.AppendUvarint(buf, tagAdded)
+		buf = binary.AppendUvarint(buf, uint64(f.level))
+		buf = binary.AppendUvarint(buf, uint64(f.index))
+	}
+	return buf
+}
+
+// 解码一个 versionEdit
+func decodeEdit(buf []byte) (versionEdit, error) {
+	var edit versionEdit
+	var err error
+	next := func() uint64 {
+		v, n := binary.Uvarint(buf)
+		if n <= 0 {
+			err = errors.New("malformed version edit")
+			return 0
+		}
+		buf = buf[n:]
+		return v
+	}
+	for len(buf) > 0 && err == nil {
+		switch tag := next(); tag {
+		case tagNextIndex:
+			edit.nextIndex = int(next())
+		case tagLastSeq:
+			edit.lastSeq = next()
+		case tagWalNumber:
+			edit.walNumber = int(next())
+		case tagDeleted:
+			edit.deleted = append(edit.deleted, tableFile{level: int(next()), index: int(next())})
+		case tagAdded:
+			edit.added = append(edit.added, tableFile{level: int(next()), index: int(next())})
+		default:
+			if err == nil {
+				err = fmt.Errorf("unknown tag %d in the version edit", tag)
+			}
+		}
+	}
+	return edit, err
+}
+
+// 将 edit 应用到回放的状态上
+func (s *versionState) apply(edit versionEdit) {
+	for _, f := range edit.deleted {
+		delete(s.live, f)
+	}
+	for _, f := range edit.added {
+		s.live[tableFile{level: f.level, index: f.index}] = struct{}{}
+	}
+	if edit.nextIndex > s.nextIndex {
+		s.nextIndex = edit.nextIndex
+	}
+	if edit.lastSeq > s.lastSeq {
+		s.lastSeq = edit.lastSeq
+	}
+	if edit.walNumber > s.walNumber {
+		s.walNumber = edit.walNumber
+	}
+}
+
+// 回放 CURRENT 指向的 MANIFEST, 没有 CURRENT 时 (旧版本的数据库) 返回 false
+func readManifest(dir string) (versionState, bool) {
+	state := versionState{live: map[tableFile]struct{}{}}
+	current, err := os.ReadFile(path.Join(dir, currentName))
+	if os.IsNotExist(err) {
+		return state, false
+	}
+	if err != nil {
+		log.Panicln("fail to read the CURRENT:", err)
+	}
+	name := strings.TrimSpace(string(current))
+	var number int
+	if _, err = fmt.Sscanf(name, manifestPrefix+"%d", &number); err != nil {
+		log.Panicf("the CURRENT points to an invalid MANIFEST %q\n", name)
+	}
+	f, err := os.Open(path.Join(dir, name))
+	if err != nil {
+		log.Panicln("fail to open the MANIFEST:", err)
+	}
+	defer f.Close()
+	reader := bufio.NewReader(f)
+	header := make([]byte, manifestHeader)
+	records := 0
+	for {
+		if _, err = io.ReadFull(reader, header); err == io.EOF {
+			break
+		}
+		if err == io.ErrUnexpectedEOF {
+			log.Printf("the %s has an incomplete record at the end, ignoring it\n", name)
+			break
+		}
+		if err != nil {
+			log.Panicln("fail to read the MANIFEST:", err)
+		}
+		data := make([]byte, binary.LittleEndian.Uint32(header[4:]))
+		if _, err = io.ReadFull(reader, data); err != nil {
+			log.Printf("the %s has an incomplete record at the end, ignoring it\n", name)
+			break
+		}
+		crc := crc32.Update(crc32.Checksum(header[4:], crcTable), crcTable, data)
+		if crc != binary.LittleEndian.Uint32(header) {
+			log.Printf("the record %d in the %s has a checksum mismatch, ignoring the rest\n", records, name)
+			break
+		}
+		edit, err := decodeEdit(data)
+		if err != nil {
+			log.Panicf("fail to decode the record %d in the %s: %v\n", records, name, err)
+		}
+		state.apply(edit)
+		records++
+	}
+	if number >= state.nextIndex {
+		state.nextIndex = number + 1
+	}
+	log.Printf("replay %d records from the %s\n", records, name)
+	return state, true
+}
+
+// 在 dir 中创建编号为 number 的 MANIFEST 并写入 snapshot, 然后将 CURRENT 指向它, 返回打开的文件和写入的字节数
+func writeManifest(dir string, number int, snapshot versionEdit) (*os.File, int64, error) {
+	f, err := os.OpenFile(path.Join(dir, manifestName(number)), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return nil, 0, err
+	}
+	n, err := appendEdit(f, snapshot)
+	// 先写入临时文件再重命名, CURRENT 总是指向一个完整的 MANIFEST
+	tmp := path.Join(dir, currentName+".tmp")
+	if err == nil {
+		err = os.WriteFile(tmp, []byte(manifestName(number)+"\n"), 0666)
+	}
+	if err == nil {
+		err = syncFile(tmp)
+	}
+	if err == nil {
+		err = os.Rename(tmp, path.Join(dir, currentName))
+	}
+	if err != nil {
+		_ = f.Close()
+		return nil, 0, err
+	}
+	syncDir(dir)
+	return f, n, nil
+}
+
+// 向 f 追加一条记录并落盘, 返回写入的字节数
+func appendEdit(f *os.File, edit versionEdit) (int64, error) {
+	data := encodeEdit(edit)
+	buf := make([]byte, manifestHeader, manifestHeader+len(data))
+	binary.LittleEndian.PutUint32(buf[4:], uint32(len(data)))
+	buf = append(buf, data...)
+	binary.LittleEndian.PutUint32(buf, crc32.Checksum(buf[4:], crcTable))
+	if _, err := f.Write(buf); err != nil {
+		return 0, err
+	}
+	return int64(len(buf)), f.Sync()
+}
+
+// 将 snapshot 写入编号为 number 的新 MANIFEST, 然后删除旧的 MANIFEST
+func (m *manifest) roll(number int, snapshot versionEdit) {
+	f, n, err := writeManifest(m.dir, number, snapshot)
+	if err != nil {
+		log.Panicln("fail to create the MANIFEST:", err)
+	}
+	if m.f != nil {
+		_ = m.f.Close()
+	}
+	m.f, m.number, m.size = f, number, n
+	// 删除旧的 MANIFEST, 包括之前崩溃时没有来得及删除的
+	files, err := os.ReadDir(m.dir)
+	if err != nil {
+		log.Panicln("failed to read the database files:", err.Error())
+	}
+	for _, file := range files {
+		if strings.HasPrefix(file.Name(), manifestPrefix) && file.Name() != manifestName(number) {
+			_ = os.Remove(path.Join(m.dir, file.Name()))
+		}
+	}
+}
+
+// 将文件落盘
+func syncFile(name string) error {
+	f, err := os.OpenFile(name, os.O_RDWR, 0666)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
+
+// 将 edit 写入 MANIFEST 并落盘, 然后在当前 version 的基础上安装新的 version
+// 被删除的 SsTable 在引用它的 version 都被释放后才会被关闭并删除, 不会等待正在进行的查找
+// 写入 MANIFEST 失败时 edit 不会生效, 新增的 SsTable 会在下次启动时被当作残留文件删除
+func (tt *TablesTree) logAndApply(edit versionEdit) {
+	m := &tt.manifest
+	m.Lock()
+	defer m.Unlock()
+	if m.size >= maxManifestSize {
+		number := tt.allocIndex()
+		tt.RLock()
+		snapshot := tt.current.snapshot(tt.nextIndex)
+		tt.RUnlock()
+		m.roll(number, snapshot)
+	}
+	tt.RLock()
+	edit.nextIndex = tt.nextIndex
+	tt.RUnlock()
+	n, err := appendEdit(m.f, edit)
+	if err != nil {
+		log.Panicln("fail to write the MANIFEST:", err)
+	}
+	m.size += n
+
+	tt.Lock()
+	old := tt.current
+	tt.current = old.apply(edit)
+	tt.Unlock()
+	old.unref()
+}
@@ -0,0 +1,206 @@
+package ssTable
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func liveSet(files ...tableFile) map[tableFile]struct{} {
+	live := map[tableFile]struct{}{}
+	for _, f := range files {
+		live[f] = struct{}{}
+	}
+	return live
+}
+
+// 写入一个快照和若干修改, 返回 MANIFEST 的路径和每条记录结束的位置
+func writeTestManifest(t *testing.T, dir string) (string, []int64) {
+	t.Helper()
+	f, n, err := writeManifest(dir, 7, versionEdit{
+		added:     []tableFile{{level: 0, index: 1}, {level: 0, index: 2}},
+		nextIndex: 8,
+		lastSeq:   10,
+		walNumber: 3,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	ends := []int64{n}
+	edits := []versionEdit{
+		// 落盘
+		{added: []tableFile{{level: 0, index: 8}}, nextIndex: 9, lastSeq: 20, walNumber: 4},
+		// 压实, 删除输入并加入输出
+		{added: []tableFile{{level: 1, index: 9}}, deleted: []tableFile{{level: 0, index: 1}, {level: 0, index: 2}, {level: 0, index: 8}}, nextIndex: 10},
+		// 导入
+		{added: []tableFile{{level: 2, index: 10}, {level: 2, index: 11}}, nextIndex: 12, lastSeq: 22},
+	}
+	for _, edit := range edits {
+		n, err := appendEdit(f, edit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ends = append(ends, ends[len(ends)-1]+n)
+	}
+	return filepath.Join(dir, manifestName(7)), ends
+}
+
+func TestEditRoundTrip(t *testing.T) {
+	edit := versionEdit{
+		added:     []tableFile{{level: 1, index: 300}, {level: 6, index: 1 << 20}},
+		deleted:   []tableFile{{level: 0, index: 5}},
+		nextIndex: 1<<20 + 1,
+		lastSeq:   1 << 40,
+		walNumber: 17,
+	}
+	got, err := decodeEdit(encodeEdit(edit))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, edit) {
+		t.Fatalf("decodeEdit = %+v, want %+v", got, edit)
+	}
+	if _, err = decodeEdit([]byte{99, 1}); err == nil {
+		t.Fatal("decoding an unknown tag should fail")
+	}
+	if _, err = decodeEdit([]byte{tagAdded, 1}); err == nil {
+		t.Fatal("decoding a truncated field should fail")
+	}
+}
+
+func TestReplayManifest(t *testing.T) {
+	dir := t.TempDir()
+	writeTestManifest(t, dir)
+	state, ok := readManifest(dir)
+	if !ok {
+		t.Fatal("the CURRENT is not found")
+	}
+	want := liveSet(tableFile{level: 1, index: 9}, tableFile{level: 2, index: 10}, tableFile{level: 2, index: 11})
+	if !reflect.DeepEqual(state.live, want) {
+		t.Fatalf("live tables = %v, want %v", state.live, want)
+	}
+	if state.nextIndex != 12 || state.lastSeq != 22 || state.walNumber != 4 {
+		t.Fatalf("replayed nextIndex %d, lastSeq %d, walNumber %d", state.nextIndex, state.lastSeq, state.walNumber)
+	}
+}
+
+// 写入记录时崩溃, 末尾不完整的记录被忽略, 之前的记录都生效
+func TestReplayTruncatedManifest(t *testing.T) {
+	_, ends := writeTestManifest(t, t.TempDir())
+	cases := []struct {
+		size int64
+		live map[tableFile]struct{}
+	}{
+		// 只有快照, 第一条修改的头部不完整
+		{ends[0] + 3, liveSet(tableFile{level: 0, index: 1}, tableFile{level: 0, index: 2})},
+		// 落盘生效, 压实的数据不完整
+		{ends[2] - 1, liveSet(tableFile{level: 0, index: 1}, tableFile{level: 0, index: 2}, tableFile{level: 0, index: 8})},
+		// 压实生效, 导入只有头部
+		{ends[2] + manifestHeader, liveSet(tableFile{level: 1, index: 9})},
+	}
+	for _, c := range cases {
+		dir := t.TempDir()
+		path, _ := writeTestManifest(t, dir)
+		if err := os.Truncate(path, c.size); err != nil {
+			t.Fatal(err)
+		}
+		state, ok := readManifest(dir)
+		if !ok {
+			t.Fatal("the CURRENT is not found")
+		}
+		if !reflect.DeepEqual(state.live, c.live) {
+			t.Fatalf("truncated to %d bytes: live tables = %v, want %v", c.size, state.live, c.live)
+		}
+		// 文件编号不会小于 MANIFEST 自身的编号
+		if state.nextIndex < 8 {
+			t.Fatalf("truncated to %d bytes: nextIndex %d", c.size, state.nextIndex)
+		}
+	}
+}
+
+// 校验和不匹配的记录及之后的记录被忽略
+func TestReplayCorruptedManifest(t *testing.T) {
+	dir := t.TempDir()
+	path, ends := writeTestManifest(t, dir)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[ends[1]+manifestHeader] ^= 0xff
+	if err = os.WriteFile(path, data, 0666); err != nil {
+		t.Fatal(err)
+	}
+	state, _ := readManifest(dir)
+	want := liveSet(tableFile{level: 0, index: 1}, tableFile{level: 0, index: 2}, tableFile{level: 0, index: 8})
+	if !reflect.DeepEqual(state.live, want) {
+		t.Fatalf("live tables = %v, want %v", state.live, want)
+	}
+}
+
+// 重写 MANIFEST 后 CURRENT 指向新的文件, 旧的文件被删除
+func TestRollManifest(t *testing.T) {
+	dir := t.TempDir()
+	old, _ := writeTestManifest(t, dir)
+	m := manifest{dir: dir}
+	m.roll(12, versionEdit{added: []tableFile{{level: 1, index: 9}}, nextIndex: 13, lastSeq: 22, walNumber: 4})
+	defer m.f.Close()
+	if _, err := os.Stat(old); !os.IsNotExist(err) {
+		t.Fatalf("the old MANIFEST still exists: %v", err)
+	}
+	state, ok := readManifest(dir)
+	if !ok || !reflect.DeepEqual(state.live, liveSet(tableFile{level: 1, index: 9})) || state.nextIndex != 13 {
+		t.Fatalf("replayed %+v %v after rolling", state, ok)
+	}
+	// 没有 CURRENT 时是旧版本的数据库
+	if _, ok = readManifest(t.TempDir()); ok {
+		t.Fatal("an empty directory should not have a MANIFEST")
+	}
+}
+
+// 启动时只加载 MANIFEST 中存活的 SsTable, 删除压实前的输入和崩溃前没有记录的输出
+func TestInitFromManifest(t *testing.T) {
+	dir := t.TempDir()
+	for _, f := range []tableFile{{level: 0, index: 1}, {level: 0, index: 2}, {level: 1, index: 9}, {level: 0, index: 20}} {
+		w, err := NewSstWriter(tablePath(dir, f), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = w.Put("key", []byte(`"value"`)); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = w.Finish(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f, _, err := writeManifest(dir, 7, versionEdit{added: []tableFile{{level: 0, index: 1}, {level: 0, index: 2}}, nextIndex: 8})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = appendEdit(f, versionEdit{added: []tableFile{{level: 1, index: 9}}, deleted: []tableFile{{level: 0, index: 1}, {level: 0, index: 2}}, nextIndex: 10})
+	_ = f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tt := &TablesTree{}
+	tt.Init(dir)
+	defer tt.current.unref()
+	defer tt.manifest.f.Close()
+	for level, nodes := range tt.current.levels {
+		for _, n := range nodes {
+			if level != 1 || n.index != 9 {
+				t.Fatalf("loaded the table %d.%d which is not live", level, n.index)
+			}
+		}
+	}
+	if len(tt.current.levels[1]) != 1 {
+		t.Fatalf("level 1 has %d tables, want 1", len(tt.current.levels[1]))
+	}
+	for _, f := range []tableFile{{level: 0, index: 1}, {level: 0, index: 2}, {level: 0, index: 20}} {
+		if _, err := os.Stat(tablePath(dir, f)); !os.IsNotExist(err) {
+			t.Fatalf("the dead table %s still exists: %v", tablePath(dir, f), err)
+		}
+	}
+}
@@ -0,0 +1,17 @@
+//go:build linux
+
+package ssTable
+
+import (
+	"os"
+	"syscall"
+)
+
+// 将文件的前 size 个字节以只读方式映射到内存中
+func mmapFile(f *os.File, size int64) ([]byte, error) {
+	return syscall.Mmap(int(f.Fd()), 0, int(size), syscall.PROT_READ, syscall.MAP_SHARED)
+}
+
+func munmapFile(data []byte) error {
+	return syscall.Munmap(data)
+}
@@ -0,0 +1,17 @@
+//go:build !linux
+
+package ssTable
+
+import (
+	"errors"
+	"os"
+)
+
+// 其他平台不支持 mmap, 调用者会退回到 pread
+func mmapFile(f *os.File, size int64) ([]byte, error) {
+	return nil, errors.New("mmap is not supported on this platform")
+}
+
+func munmapFile(data []byte) error {
+	return nil
+}
@@ -0,0 +1,151 @@
+package ssTable
+
+import (
+	"encoding/binary"
+	"errors"
+	"qlsm/codec"
+	"qlsm/kv"
+	"time"
+)
+
+/*
+属性块依次保存 Properties 的各个字段, 整数使用 uvarint 编码, key 之前保存它的长度
+┌──────────────────────┬──────────────────────┬─────────┬────────────┬────────────┬──────────────┬───────────┬────────┬────────┬───────┬───────┐
+│ keyLen | SmallestKey │ keyLen | LargestKey  │ Entries │ Tombstones │ RawKeySize │ RawValueSize │ CreatedAt │ MinSeq │ MaxSeq │ Codec │ Level │
+└──────────────────────┴──────────────────────┴─────────┴────────────┴────────────┴──────────────┴───────────┴────────┴────────┴───────┴───────┘
+*/
+
+// Properties 描述一个 SsTable 的内容, 写入时生成并保存在属性块中, 只需读取文件末尾就能获得
+type Properties struct {
+	SmallestKey  string      // 最小的 key
+	LargestKey   string      // 最大的 key
+	Entries      int64       // 元素数量, 包括墓碑
+	Tombstones   int64       // 墓碑数量
+	RawKeySize   int64       // 所有 key 的字节数
+	RawValueSize int64       // 所有值压缩前的字节数
+	CreatedAt    time.Time   // 创建时间
+	MinSeq       uint64      // 包含的最小的 Wal 序列号, 为 0 时表示未知
+	MaxSeq       uint64      // 包含的最大的 Wal 序列号, 为 0 时表示未知
+	Codec        codec.Codec // 数据块的压缩算法
+	Level        int         // 写入时所在的层
+}
+
+// SeqRange 是一段 Wal 序列号的范围, 两端都包含, 为 0 时表示未知
+type SeqRange struct {
+	Min uint64
+	Max uint64
+}
+
+// 统计一个写入的元素
+func (p *Properties) add(data kv.Data) {
+	if p.Entries == 0 {
+		p.SmallestKey = data.Key
+	}
+	p.LargestKey = data.Key
+	p.Entries++
+	if data.Deleted {
+		p.Tombstones++
+	}
+	p.RawKeySize += int64(len(data.Key))
+	p.RawValueSize += int64(len(data.Value))
+}
+
+// 判断 key 是否在 SsTable 的 key 范围内
+func (p *Properties) containsKey(key string) bool {
+	return p.Entries > 0 && key >= p.SmallestKey && key <= p.LargestKey
+}
+
+// 编码属性块
+func encodeProperties(p Properties) []byte {
+	var buf []byte
+	buf = binary.AppendUvarint(buf, uint64(len(p.SmallestKey)))
+	buf = append(buf, p.SmallestKey...)
+	buf = binary.AppendUvarint(buf, uint64(len(p.LargestKey)))
+	buf = append(buf, p.LargestKey...)
+	for _, v := range []uint64{
+		uint64(p.Entries), uint64(p.Tombstones), uint64(p.RawKeySize), uint64(p.RawValueSize),
+		uint64(p.CreatedAt.UnixNano()), p.MinSeq, p.MaxSeq, uint64(p.Codec), uint64(p.Level),
+	} {
+		buf = binary.AppendUvarint(buf, v)
+	}
+	return buf
+}
+
+// 解码属性块
+func decodeProperties(buf []byte) (Properties, error) {
+	errBad := errors.New("malformed properties block")
+	readKey := func() (string, bool) {
+		n, l := binary.Uvarint(buf)
+		if l <= 0 || uint64(len(buf)-l) < n {
+			return "", false
+		}
+		key := string(buf[l : l+int(n)])
+		buf = buf[l+int(n):]
+		return key, true
+	}
+	var p Properties
+	var ok bool
+	if p.SmallestKey, ok = readKey(); !ok {
+		return p, errBad
+	}
+	if p.LargestKey, ok = readKey(); !ok {
+		return p, errBad
+	}
+	var fields [9]uint64
+	for i := range fields {
+		v, l := binary.Uvarint(buf)
+		if l <= 0 {
+			return p, errBad
+		}
+		fields[i] = v
+		buf = buf[l:]
+	}
+	p.Entries, p.Tombstones = int64(fields[0]), int64(fields[1])
+	p.RawKeySize, p.RawValueSize = int64(fields[2]), int64(fields[3])
+	p.CreatedAt = time.Unix(0, int64(fields[4]))
+	p.MinSeq, p.MaxSeq = fields[5], fields[6]
+	p.Codec, p.Level = codec.Codec(fields[7]), int(fields[8])
+	return p, nil
+}
+
+// Properties 获取 SsTable 的属性, 版本 5 之前的文件没有属性块, 返回 false
+func (t *SsTable) Properties() (Properties, bool) {
+	if t.props == nil {
+		return Properties{}, false
+	}
+	return *t.props, true
+}
+
+// ReadProperties 只读取 db 文件末尾的元数据和属性块, 不加载索引和过滤器
+func ReadProperties(path string) (Properties, bool, error) {
+	t := &SsTable{filepath: path}
+	if err := t.open(); err != nil {
+		return Properties{}, false, err
+	}
+	defer t.close()
+	if err := t.loadMetaInfo(); err != nil {
+		return Properties{}, false, err
+	}
+	if err := t.loadProperties(); err != nil {
+		return Properties{}, false, err
+	}
+	p, ok := t.Properties()
+	return p, ok, nil
+}
+
+// 读取属性块, 版本 5 之前的文件没有属性块
+func (t *SsTable) loadProperties() error {
+	if t.metaInfo.version < versionProperties {
+		return nil
+	}
+	bs, err := t.readBlockAt(t.metaInfo.propsStart, t.metaInfo.propsLen)
+	if err != nil {
+		return err
+	}
+	p, err := decodeProperties(bs)
+	if err != nil {
+		return t.corruption(t.metaInfo.propsStart, err.Error())
+	}
+	t.props = &p
+	return nil
+}
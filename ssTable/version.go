@@ -0,0 +1,118 @@
+package ssTable
+
+import (
+	"log"
+	"os"
+	"sync/atomic"
+)
+
+// tableNode 是 version 中的一个 SsTable
+type tableNode struct {
+	index int // 文件编号, 同一层中越大越新
+	table *SsTable
+}
+
+// version 是 TablesTree 在某一时刻的 SsTable 集合, 创建后不再修改
+// TablesTree 持有当前的 version, 查找、压实、导入和备份通过 ref 持有开始时的 version, 之后不需要 TablesTree 的锁
+// 修改 TablesTree 时安装一个新的 version, 不会等待持有旧 version 的读者
+// version 的引用计数归零时释放它对其中 SsTable 的引用, SsTable 不再被任何 version 引用时才会被关闭并删除
+type version struct {
+	levels    [][]tableNode // 各层的 SsTable, 同一层中从旧到新排列
+	lastSeq   uint64        // 已写入 SsTable 的最大序列号
+	walNumber int           // 编号小于它的 Wal 段中的数据都已写入 SsTable
+	refs      atomic.Int32
+}
+
+// 创建一个有 levels 层的空 version
+func newVersion(levels int) *version {
+	return &version{levels: make([][]tableNode, levels)}
+}
+
+// 在 v 的基础上应用 edit, 返回被 TablesTree 持有的新 version, 它引用其中所有的 SsTable
+func (v *version) apply(edit versionEdit) *version {
+	deleted := make(map[tableFile]struct{}, len(edit.deleted))
+	for _, f := range edit.deleted {
+		deleted[tableFile{level: f.level, index: f.index}] = struct{}{}
+	}
+	nv := newVersion(len(v.levels))
+	for level, nodes := range v.levels {
+		for _, n := range nodes {
+			if _, ok := deleted[tableFile{level: level, index: n.index}]; !ok {
+				nv.levels[level] = append(nv.levels[level], n)
+			}
+		}
+	}
+	for _, f := range edit.added {
+		nv.levels[f.level] = append(nv.levels[f.level], tableNode{index: f.index, table: f.table})
+	}
+	nv.lastSeq, nv.walNumber = v.lastSeq, v.walNumber
+	if edit.lastSeq > nv.lastSeq {
+		nv.lastSeq = edit.lastSeq
+	}
+	if edit.walNumber > nv.walNumber {
+		nv.walNumber = edit.walNumber
+	}
+	for _, nodes := range nv.levels {
+		for _, n := range nodes {
+			n.table.refs.Add(1)
+		}
+	}
+	nv.refs.Add(1)
+	return nv
+}
+
+// 释放一个对 version 的引用, 引用计数归零时释放它对 SsTable 的引用
+func (v *version) unref() {
+	if v.refs.Add(-1) > 0 {
+		return
+	}
+	for _, nodes := range v.levels {
+		for _, n := range nodes {
+			n.table.unref()
+		}
+	}
+}
+
+// 释放一个 version 对 SsTable 的引用, 没有 version 引用它时说明它已从 TablesTree 中删除, 关闭并删除文件
+func (t *SsTable) unref() {
+	if t.refs.Add(-1) > 0 {
+		return
+	}
+	if err := t.close(); err != nil {
+		log.Println("fail to close file", t.filepath)
+		panic(err)
+	}
+	if err := os.Remove(t.filepath); err != nil {
+		log.Println("fail to delete file", t.filepath)
+		panic(err)
+	}
+}
+
+// 获取并引用当前的 version, 使用完后需调用 unref
+func (tt *TablesTree) ref() *version {
+	tt.RLock()
+	defer tt.RUnlock()
+	// 当前的 version 被 TablesTree 引用, 持有读锁时不会被释放
+	v := tt.current
+	v.refs.Add(1)
+	return v
+}
+
+// 获取 level 层 SsTable 的总文件大小
+func (v *version) levelSize(level int) (size int64) {
+	for _, n := range v.levels[level] {
+		size += n.table.getDBSize()
+	}
+	return size
+}
+
+// 生成 v 的快照, 写入新的 MANIFEST 或备份, nextIndex 是下一个文件编号
+func (v *version) snapshot(nextIndex int) versionEdit {
+	edit := versionEdit{nextIndex: nextIndex, lastSeq: v.lastSeq, walNumber: v.walNumber}
+	for level, nodes := range v.levels {
+		for _, n := range nodes {
+			edit.added = append(edit.added, tableFile{level: level, index: n.index})
+		}
+	}
+	return edit
+}
@@ -0,0 +1,19 @@
+package lsm
+
+import "qlsm/ssTable"
+
+// FilterStats 是 SsTable 的 Bloom 过滤器的统计信息
+type FilterStats = ssTable.FilterStats
+
+// GetFilterStats 获取数据库启动以来 Bloom 过滤器的统计信息
+func GetFilterStats() FilterStats {
+	return db.TablesTree.FilterStats()
+}
+
+// CacheStats 是 SsTable 块缓存的统计信息
+type CacheStats = ssTable.CacheStats
+
+// GetCacheStats 获取数据库启动以来块缓存的统计信息
+func GetCacheStats() CacheStats {
+	return db.TablesTree.CacheStats()
+}
@@ -0,0 +1,387 @@
+package vlog
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+/*
+ValueLog 由若干个编号递增的文件组成, 例如 000001.vlog, 000002.vlog, 只向最新的文件追加
+MemTable 落盘时较大的值写入 ValueLog, SsTable 中只保存指向它的指针, 见 pointer.go
+Wal 和 MemTable 中保存完整的值, 因此回收 ValueLog 的文件不会影响 Wal 的回放、归档和复制
+每条记录的格式为
+┌──────────┬──────────────────┬────────────────────┬─────┬───────┐
+│ crc32(4) │ keyLen (uvarint) │ valueLen (uvarint) │ key │ value │
+└──────────┴──────────────────┴────────────────────┴─────┴───────┘
+crc 使用 CRC32C, 覆盖 crc 之后的所有字节, 保存 key 是为了在回收时判断记录是否仍然有效
+*/
+
+const (
+	fileSuffix      = ".vlog"
+	defaultFileSize = 64      // 默认的单个文件大小 (MB)
+	maxRecordSize   = 1 << 32 // 记录中 key 和值的总长度的上限, 超过时认为长度已损坏
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// ErrCorruption 表示 ValueLog 中的记录已损坏
+var ErrCorruption = errors.New("vlog: corrupted record")
+
+// ValueLog 保存与 key 分离存储的值
+type ValueLog struct {
+	dir     string
+	maxSize int64            // 单个文件的最大大小, 超过后开启新的文件
+	files   map[int]*os.File // 所有文件的句柄
+	f       *os.File         // 当前追加的文件
+	number  int              // 当前文件的编号
+	offset  int64            // 当前文件的末尾
+	// 读取持有读锁, 追加、开启新文件和删除文件持有写锁
+	sync.RWMutex
+}
+
+// Open 打开 dir 中的 ValueLog, 继续向最新的文件追加, 单个文件超过 fileSize (MB) 后开启新的文件, 为 0 时使用 64MB
+func Open(dir string, fileSize int) *ValueLog {
+	if fileSize <= 0 {
+		fileSize = defaultFileSize
+	}
+	l := &ValueLog{dir: dir, maxSize: int64(fileSize) << 20, files: map[int]*os.File{}}
+	numbers := listFiles(dir)
+	for _, number := range numbers {
+		f, err := os.OpenFile(filePath(dir, number), os.O_RDWR, 0666)
+		if err != nil {
+			log.Panicln("fail to open the value log:", err)
+		}
+		l.files[number] = f
+	}
+	if len(numbers) == 0 {
+		l.newFile(1)
+		return l
+	}
+	l.number = numbers[len(numbers)-1]
+	l.f = l.files[l.number]
+	// 崩溃时最后一条记录可能只写入了一部分, 从最后一条完整的记录之后继续追加
+	l.offset = validLength(l.f)
+	if err := l.f.Truncate(l.offset); err != nil {
+		log.Panicln("fail to truncate the value log:", err)
+	}
+	return l
+}
+
+// 获取文件中完整的记录的总长度
+func validLength(f *os.File) int64 {
+	r := bufio.NewReader(io.NewSectionReader(f, 0, 1<<62))
+	var offset int64
+	for {
+		record, err := readRecord(r)
+		if err != nil {
+			return offset
+		}
+		if _, _, err = decodeRecord(record); err != nil {
+			return offset
+		}
+		offset += int64(len(record))
+	}
+}
+
+// 创建并切换到 number 号文件, 调用者需持有写锁
+func (l *ValueLog) newFile(number int) {
+	f, err := os.OpenFile(filePath(l.dir, number), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		log.Panicln("fail to create the value log:", err)
+	}
+	syncDir(l.dir)
+	l.files[number] = f
+	l.f, l.number, l.offset = f, number, 0
+}
+
+// Append 追加一条记录, 返回指向它的指针, 当前文件已满时先封存它并开启新的文件
+// 记录只写入操作系统的缓存, 与 Wal 一样需要调用 Sync 才能保证持久化
+func (l *ValueLog) Append(key string, value []byte) []byte {
+	l.Lock()
+	defer l.Unlock()
+	if l.offset >= l.maxSize {
+		if err := l.f.Sync(); err != nil {
+			log.Panicln("fail to sync the value log:", err)
+		}
+		l.newFile(l.number + 1)
+	}
+	record := encodeRecord(key, value)
+	if _, err := l.f.WriteAt(record, l.offset); err != nil {
+		log.Panicln("fail to write the value log:", err)
+	}
+	p := Pointer{Number: l.number, Offset: l.offset, Length: int64(len(record))}
+	l.offset += int64(len(record))
+	return p.Encode()
+}
+
+// Read 读取 p 指向的记录中的值
+func (l *ValueLog) Read(p Pointer) ([]byte, error) {
+	l.RLock()
+	defer l.RUnlock()
+	f, ok := l.files[p.Number]
+	if !ok {
+		return nil, fmt.Errorf("vlog: file %d does not exist", p.Number)
+	}
+	buf := make([]byte, p.Length)
+	if _, err := f.ReadAt(buf, p.Offset); err != nil {
+		return nil, err
+	}
+	_, value, err := decodeRecord(buf)
+	return value, err
+}
+
+// Resolve 将指针还原为它指向的值, 不是指针的值原样返回
+func (l *ValueLog) Resolve(value []byte) ([]byte, error) {
+	p, ok := DecodePointer(value)
+	if !ok {
+		return value, nil
+	}
+	return l.Read(p)
+}
+
+// Sync 将当前文件落盘, 封存的文件在开启新文件时已经落盘
+func (l *ValueLog) Sync() {
+	l.Lock()
+	defer l.Unlock()
+	if err := l.f.Sync(); err != nil {
+		log.Panicln("fail to sync the value log:", err)
+	}
+}
+
+// Sealed 获取已封存 (不再追加) 的文件编号, 按编号递增排列
+func (l *ValueLog) Sealed() []int {
+	l.RLock()
+	defer l.RUnlock()
+	var numbers []int
+	for number := range l.files {
+		if number != l.number {
+			numbers = append(numbers, number)
+		}
+	}
+	sort.Ints(numbers)
+	return numbers
+}
+
+// Size 获取 number 号文件的大小
+func (l *ValueLog) Size(number int) (int64, error) {
+	l.RLock()
+	defer l.RUnlock()
+	f, ok := l.files[number]
+	if !ok {
+		return 0, fmt.Errorf("vlog: file %d does not exist", number)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// Scan 按顺序遍历 number 号封存文件中的记录, fn 的参数为记录的 key、值和指向它的指针
+// fn 返回错误时停止遍历并返回该错误
+func (l *ValueLog) Scan(number int, fn func(key string, value []byte, p Pointer) error) error {
+	l.RLock()
+	f, ok := l.files[number]
+	l.RUnlock()
+	if !ok || number == l.currentNumber() {
+		return fmt.Errorf("vlog: file %d is not sealed", number)
+	}
+	r := bufio.NewReader(io.NewSectionReader(f, 0, 1<<62))
+	var offset int64
+	for {
+		record, err := readRecord(r)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%w: file %d, offset %d", err, number, offset)
+		}
+		key, value, err := decodeRecord(record)
+		if err != nil {
+			return fmt.Errorf("%w: file %d, offset %d", err, number, offset)
+		}
+		p := Pointer{Number: number, Offset: offset, Length: int64(len(record))}
+		if err = fn(key, value, p); err != nil {
+			return err
+		}
+		offset += int64(len(record))
+	}
+}
+
+func (l *ValueLog) currentNumber() int {
+	l.RLock()
+	defer l.RUnlock()
+	return l.number
+}
+
+// Remove 删除 number 号封存文件, 调用者需保证不再有指向它的有效指针, 也不会再读取它
+func (l *ValueLog) Remove(number int) {
+	l.Lock()
+	defer l.Unlock()
+	f, ok := l.files[number]
+	if !ok || number == l.number {
+		return
+	}
+	delete(l.files, number)
+	_ = f.Close()
+	if err := os.Remove(filePath(l.dir, number)); err != nil {
+		log.Panicln("fail to delete the value log:", err)
+	}
+	syncDir(l.dir)
+}
+
+// Backup 将所有文件复制到 dir 中, 封存的文件尽量以硬链接的方式备份
+// 调用期间不能有新的写入, 否则备份中的当前文件可能只包含部分记录
+func (l *ValueLog) Backup(dir string) error {
+	l.Lock()
+	defer l.Unlock()
+	if err := l.f.Sync(); err != nil {
+		return err
+	}
+	for number := range l.files {
+		src, dst := filePath(l.dir, number), filePath(dir, number)
+		// 之前的备份中的同名文件可能是同一个文件的硬链接, 直接覆盖写入会截断原文件
+		if err := os.Remove(dst); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if number != l.number {
+			if err := os.Link(src, dst); err == nil {
+				continue
+			}
+		}
+		if err := copyFile(src, dst); err != nil {
+			return err
+		}
+	}
+	syncDir(dir)
+	return nil
+}
+
+// 编码一条记录
+func encodeRecord(key string, value []byte) []byte {
+	buf := make([]byte, 4, 4+2*binary.MaxVarintLen64+len(key)+len(value))
+	buf = binary.AppendUvarint(buf, uint64(len(key)))
+	buf = binary.AppendUvarint(buf, uint64(len(value)))
+	buf = append(buf, key...)
+	buf = append(buf, value...)
+	binary.LittleEndian.PutUint32(buf, crc32.Checksum(buf[4:], crcTable))
+	return buf
+}
+
+// 校验并解码一条完整的记录
+func decodeRecord(record []byte) (string, []byte, error) {
+	if len(record) < 4 || binary.LittleEndian.Uint32(record) != crc32.Checksum(record[4:], crcTable) {
+		return "", nil, ErrCorruption
+	}
+	buf := record[4:]
+	keyLen, n := binary.Uvarint(buf)
+	if n <= 0 {
+		return "", nil, ErrCorruption
+	}
+	buf = buf[n:]
+	valueLen, n := binary.Uvarint(buf)
+	if n <= 0 || uint64(len(buf)-n) != keyLen+valueLen {
+		return "", nil, ErrCorruption
+	}
+	buf = buf[n:]
+	return string(buf[:keyLen]), buf[keyLen:], nil
+}
+
+// 从 r 中读取一条完整的记录, 已经读到文件末尾时返回 io.EOF
+func readRecord(r *bufio.Reader) ([]byte, error) {
+	header, err := r.Peek(4 + 2*binary.MaxVarintLen64)
+	if len(header) == 0 {
+		return nil, io.EOF
+	}
+	if len(header) < 4 {
+		return nil, ErrCorruption
+	}
+	keyLen, n := binary.Uvarint(header[4:])
+	if n <= 0 {
+		return nil, ErrCorruption
+	}
+	valueLen, m := binary.Uvarint(header[4+n:])
+	if m <= 0 || keyLen+valueLen > maxRecordSize {
+		return nil, ErrCorruption
+	}
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	record := make([]byte, uint64(4+n+m)+keyLen+valueLen)
+	if _, err = io.ReadFull(r, record); err != nil {
+		return nil, ErrCorruption
+	}
+	return record, nil
+}
+
+// 获取文件的路径
+func filePath(dir string, number int) string {
+	return path.Join(dir, fmt.Sprintf("%06d%s", number, fileSuffix))
+}
+
+// 获取目录中所有文件的编号, 按编号递增排列
+func listFiles(dir string) []int {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		log.Panicln("fail to read the value log directory:", err)
+	}
+	var numbers []int
+	for _, e := range entries {
+		name := e.Name()
+		if !strings.HasSuffix(name, fileSuffix) {
+			continue
+		}
+		number, err := strconv.Atoi(strings.TrimSuffix(name, fileSuffix))
+		if err != nil {
+			continue
+		}
+		numbers = append(numbers, number)
+	}
+	sort.Ints(numbers)
+	return numbers
+}
+
+// 将 src 复制到 dst 并落盘
+func copyFile(src string, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, in); err != nil {
+		_ = out.Close()
+		return err
+	}
+	if err = out.Sync(); err != nil {
+		_ = out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// 将目录落盘, 保证文件的创建和删除持久化
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		log.Panicln("fail to open the directory:", err)
+	}
+	defer d.Close()
+	if err = d.Sync(); err != nil {
+		log.Panicln("fail to sync the directory:", err)
+	}
+}
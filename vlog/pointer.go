@@ -0,0 +1,51 @@
+package vlog
+
+import "encoding/binary"
+
+/*
+指针代替值保存在 SsTable 中, 格式为
+┌────────┬──────────────────┬──────────────────┬──────────────────┐
+│ 0x00   │ number (uvarint) │ offset (uvarint) │ length (uvarint) │
+└────────┴──────────────────┴──────────────────┴──────────────────┘
+Set 写入的值是 JSON, 不会以 0x00 开头, 因此可以通过第一个字节区分指针和普通的值
+*/
+
+// pointerTag 是指针的第一个字节
+const pointerTag = 0x00
+
+// Pointer 指向 ValueLog 中的一条记录
+type Pointer struct {
+	Number int   // 文件编号
+	Offset int64 // 记录在文件中的位置
+	Length int64 // 记录的长度
+}
+
+// Encode 将指针编码为可以代替值保存的字节数组
+func (p Pointer) Encode() []byte {
+	buf := make([]byte, 1, 1+3*binary.MaxVarintLen64)
+	buf[0] = pointerTag
+	buf = binary.AppendUvarint(buf, uint64(p.Number))
+	buf = binary.AppendUvarint(buf, uint64(p.Offset))
+	return binary.AppendUvarint(buf, uint64(p.Length))
+}
+
+// DecodePointer 解码保存的值, 值不是指针时返回 false
+func DecodePointer(value []byte) (Pointer, bool) {
+	if len(value) == 0 || value[0] != pointerTag {
+		return Pointer{}, false
+	}
+	var fields [3]uint64
+	buf := value[1:]
+	for i := range fields {
+		v, n := binary.Uvarint(buf)
+		if n <= 0 {
+			return Pointer{}, false
+		}
+		fields[i] = v
+		buf = buf[n:]
+	}
+	if len(buf) != 0 {
+		return Pointer{}, false
+	}
+	return Pointer{Number: int(fields[0]), Offset: int64(fields[1]), Length: int64(fields[2])}, true
+}
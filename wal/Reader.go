@@ -0,0 +1,156 @@
+package wal
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"os"
+)
+
+var (
+	// ErrSequenceUnavailable 表示起始序列号之后的记录已经不在保留的段中
+	ErrSequenceUnavailable = errors.New("wal: the sequence number is no longer retained")
+	// ErrReaderClosed 表示 Reader 已经关闭
+	ErrReaderClosed = errors.New("wal: the reader is closed")
+)
+
+// Reader 从保留的 Wal 段中按序列号顺序读取已写入的记录
+// 读到最新的记录后, Next 会阻塞直到有新的记录写入, 类似 tail -f
+// Reader 正在使用的段及之后的段在落盘后不会被删除, 不再使用时必须调用 Close
+type Reader struct {
+	w      *Wal
+	f      *os.File // 正在读取的段
+	number int      // 正在读取的段编号
+	offset int64    // 下一条记录在段中的位置
+	seq    uint64   // 下一条返回的记录的最小序列号
+	d      *decoder
+	closed bool
+}
+
+// NewReader 创建一个从序列号 seq 开始读取的 Reader
+func (w *Wal) NewReader(seq uint64) (*Reader, error) {
+	w.Lock()
+	defer w.Unlock()
+	if seq == 0 {
+		seq = 1
+	}
+	// 从新到旧找到第一条记录不晚于 seq 的段
+	numbers := append(append([]int{}, w.flushed...), w.segments...)
+	for i := len(numbers) - 1; i >= 0; i-- {
+		f, header, err := w.openSegment(numbers[i])
+		if err != nil {
+			return nil, err
+		}
+		// 旧版本的段没有序列号, 无法定位
+		if header.Magic != segmentMagic {
+			_ = f.Close()
+			break
+		}
+		if header.BaseSeq >= seq {
+			_ = f.Close()
+			continue
+		}
+		r := &Reader{w: w, f: f, number: numbers[i], offset: headerSize, seq: seq}
+		r.d = newDecoder(header, r.number, 0)
+		w.readers[r] = struct{}{}
+		return r, nil
+	}
+	return nil, ErrSequenceUnavailable
+}
+
+// Next 返回下一条记录, 没有新记录时阻塞等待
+func (r *Reader) Next() (Record, error) {
+	for {
+		r.w.Lock()
+		if r.closed {
+			r.w.Unlock()
+			return Record{}, ErrReaderClosed
+		}
+		sealed := r.number < r.w.number
+		seq := r.w.seq
+		r.w.Unlock()
+
+		record, n, err := r.read()
+		if err == nil {
+			r.offset += n
+			if record.Seq < r.seq {
+				continue
+			}
+			r.seq = record.Seq + 1
+			return record, nil
+		}
+		if err != io.EOF && err != io.ErrUnexpectedEOF {
+			return Record{}, err
+		}
+		// 当前段已经写完, 转到下一个段
+		if sealed {
+			if err = r.advance(); err != nil {
+				return Record{}, err
+			}
+			continue
+		}
+		// 等待新的记录写入或开启新的段
+		r.w.Lock()
+		for !r.closed && r.w.seq == seq && r.w.number == r.number {
+			r.w.cond.Wait()
+		}
+		r.w.Unlock()
+	}
+}
+
+// Close 关闭 Reader, 释放它占用的段
+func (r *Reader) Close() error {
+	r.w.Lock()
+	defer r.w.Unlock()
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+	delete(r.w.readers, r)
+	r.w.release()
+	r.w.cond.Broadcast()
+	return r.f.Close()
+}
+
+// 从当前位置读取一条完整的记录
+func (r *Reader) read() (Record, int64, error) {
+	info, err := r.f.Stat()
+	if err != nil {
+		return Record{}, 0, err
+	}
+	remain := info.Size() - r.offset
+	return r.d.decode(io.NewSectionReader(r.f, r.offset, remain), remain)
+}
+
+// 转到下一个段, 并释放不再使用的段
+func (r *Reader) advance() error {
+	r.w.Lock()
+	defer r.w.Unlock()
+	if r.closed {
+		return ErrReaderClosed
+	}
+	f, header, err := r.w.openSegment(r.number + 1)
+	if err != nil {
+		return err
+	}
+	_ = r.f.Close()
+	r.f = f
+	r.number++
+	r.offset = headerSize
+	r.d = newDecoder(header, r.number, r.d.seq)
+	r.w.release()
+	return nil
+}
+
+// 以只读方式打开一个保留的段并读取段头, 调用者需持有锁
+func (w *Wal) openSegment(number int) (*os.File, segmentHeader, error) {
+	f, err := os.Open(segmentPath(w.dir, number))
+	if errors.Is(err, os.ErrNotExist) {
+		f, err = os.Open(flushedPath(w.dir, number))
+	}
+	if err != nil {
+		return nil, segmentHeader{}, err
+	}
+	header, _ := readHeader(bufio.NewReaderSize(f, headerSize))
+	return f, header, nil
+}
@@ -1,131 +1,395 @@
 package wal
 
 import (
-	"bytes"
-	"encoding/binary"
-	"encoding/json"
+	"bufio"
+	"io"
 	"log"
+	"math"
 	"os"
 	"path"
+	"qlsm/config"
 	"qlsm/kv"
 	"qlsm/memTable"
-	"qlsm/memTable/skiplist"
 	"sync"
 	"time"
 )
 
+/*
+Wal 由若干个编号递增的段文件组成, 例如 000001.wal, 000002.wal
+MemTable 被封存时开启一个新的段, 旧段中的数据都属于被封存的 MemTable,
+只有当这个 MemTable 对应的 SsTable 落盘并加入 TablesTree 后, 旧段才会被删除,
+仍被 Reader 使用的旧段会被重命名为 000001.wal.flushed, 直到不再被使用,
+不再需要的旧段可以被重命名为 000001.wal.recycle, 之后作为新的段被复用
+*/
+
+// legacyName 是旧版本单文件 Wal 的文件名, 加载时会被重命名为 0 号段
+const legacyName = "wal.log"
+
 type Wal struct {
-	f    *os.File
-	path string
+	f        *os.File             // 当前写入的段
+	dir      string               // Wal 所在目录
+	number   int                  // 当前段的编号
+	segments []int                // 启动时需要回放的段编号, 递增
+	flushed  []int                // 已落盘但仍被 Reader 使用的段编号, 递增
+	recycled []int                // 等待复用的段文件编号
+	readers  map[*Reader]struct{} // 正在读取 Wal 的 Reader
+	seq      uint64               // 最后一条记录的序列号
+	memSeq   uint64               // 当前 MemTable 中第一条记录的序列号, 没有记录时为 0
+	offset   int64                // 当前段的逻辑末尾, 预分配或复用的段文件大小会大于它
+	size     int64                // 属于当前 MemTable 的 Wal 字节数, 不包含预分配的空间
+	cond     *sync.Cond           // 写入新记录或开启新段时通知 Reader
 	sync.Mutex
 }
 
-// GetSize 获取 Wal大小, 单位字节
+// GetSize 获取属于当前 MemTable 的 Wal 大小 (按记录的字节数计算, 不包含预分配的空间), 单位字节
 func (w *Wal) GetSize() int64 {
-	info, err := w.f.Stat()
-	if err != nil {
-		log.Fatal(err)
-		return -1
-	}
-	return info.Size()
+	w.Lock()
+	defer w.Unlock()
+	return w.size
 }
 
-// Load 通过 wal.log 文件初始化 Wal, 加载文件中的 WalF 到内存
-func (w *Wal) Load(dir string) memTable.MemTable {
+// Load 按编号顺序流式回放目录中所有的 Wal 段, 恢复出 MemTable, 并开启一个新的段用于追加
+// 编号小于 flushed 的段中的数据都已写入 SsTable, 不再回放, 直接删除 (或归档), lastSeq 是已写入 SsTable 的最大序列号
+// 回放出的数据超过 MemTable 阈值时, 会调用 flush 将其写入 0 层, 并换用新的 MemTable, 之后删除数据都已落盘的段
+// flush 的参数 first 和 last 是 MemTable 中第一条和最后一条记录的序列号,
+// 编号小于 number 的段中的数据都已包含在这次及之前落盘的 MemTable 中, 之后崩溃时从 number 号段开始回放
+func (w *Wal) Load(dir string, flushed int, lastSeq uint64, flush func(mt memTable.MemTable, first uint64, last uint64, number int)) memTable.MemTable {
 	start := time.Now()
-	defer func() {
-		log.Println("load the wal.log, consumption of time:", time.Since(start))
-	}()
-	walPath := path.Join(dir, "wal.log")
-	f, err := os.OpenFile(walPath, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
-	if err != nil {
-		log.Panicln("fail to open the wal.log:", err)
-	}
 	w.Lock()
 	defer w.Unlock()
-	w.f = f
-	w.path = walPath
+	w.dir = dir
+	w.readers = map[*Reader]struct{}{}
+	w.cond = sync.NewCond(&w.Mutex)
 
-	size := w.GetSize()
-	t := skiplist.New()
+	// 旧版本的 wal.log 作为 0 号段参与回放
+	legacyPath := path.Join(dir, legacyName)
+	if _, err := os.Stat(legacyPath); err == nil {
+		if err = os.Rename(legacyPath, segmentPath(dir, 0)); err != nil {
+			log.Panicln("fail to rename the wal.log:", err)
+		}
+	}
 
-	if size == 0 {
-		return t
+	// 落盘后立即删除之前的段, 之后崩溃不会再次回放这些段, 在 0 层重复写入相同的数据
+	r := &replayer{t: config.GetConfig().MemTableFactory(), flush: flush, remove: w.remove, start: start}
+	w.segments = listSegments(dir, "")
+	w.flushed = listSegments(dir, flushedSuffix)
+	w.recycled = listSegments(dir, recycleSuffix)
+	// 落盘后、删除段之前崩溃时留下的段
+	for len(w.segments) > 0 && w.segments[0] < flushed {
+		w.discard(segmentPath(dir, w.segments[0]), w.segments[0])
+		w.number = w.segments[0]
+		w.segments = w.segments[1:]
 	}
-	if _, err = w.f.Seek(0, 0); err != nil {
-		log.Panicln("fail to open the wal.log:", err)
+	var last segmentInfo
+	for _, number := range w.segments {
+		last = r.replaySegment(segmentPath(dir, number), number)
+		w.number = number
 	}
+	// 最新的段中没有记录时直接复用, 避免每次启动都留下一个空段
+	reuse := len(w.segments) > 0 && last.version == segmentVersion && last.records == 0
+	// 回放期间落盘过时剩余的数据也一起落盘, 否则这些段要等到下一次落盘才能删除, 期间每次启动都会重复写入已落盘的部分
+	if r.flushed && r.t.GetCount() > 0 {
+		r.full = true
+		if reuse {
+			// 复用的段之后会写入新的记录
+			r.flushBefore(w.number)
+		} else {
+			r.flushBefore(w.number + 1)
+		}
+	}
+	r.report()
+	log.Printf("load %d records from the wal segments, consumption of time: %v\n", r.records, time.Since(start))
+	w.size = r.pending
+	w.seq = r.seq
+	if lastSeq > w.seq {
+		w.seq = lastSeq
+	}
+	w.memSeq = r.first
 
-	// 文件指针移动到最后，以便追加
-	defer func(f *os.File) {
-		_, err = f.Seek(0, 2)
+	if reuse {
+		f, err := os.OpenFile(segmentPath(dir, w.number), os.O_RDWR, 0666)
 		if err != nil {
-			log.Println("fail to open the wal.log")
-			panic(err)
+			log.Panicln("fail to open the wal segment:", err)
 		}
-	}(w.f)
-
-	// 将文件内容全部读取到内存
-	data := make([]byte, size)
-	if _, err = w.f.Read(data); err != nil {
-		log.Panicln("fail to read the wal.log:", err)
-	}
-
-	dataLen := int64(0) // 元素的字节数量
-	index := int64(0)   // 当前索引
-	for index < size {
-		// 获取元素的字节长度
-		dataLenArea := data[index : index+8]
-		buf := bytes.NewReader(dataLenArea)
-		if err = binary.Read(buf, binary.LittleEndian, &dataLen); err != nil {
-			log.Panicln("fail to read for dataLen:", err)
+		w.f = f
+		w.offset = headerSize
+		return r.t
+	}
+	// 新段的编号要大于所有保留的段
+	if n := lastNumber(w.flushed); n > w.number {
+		w.number = n
+	}
+	w.newSegment()
+	return r.t
+}
+
+// 开启下一个编号的段, 有等待复用的文件时优先复用, 调用者需持有锁
+func (w *Wal) newSegment() {
+	w.number++
+	if len(w.recycled) > 0 {
+		w.f = recycleSegment(w.dir, w.recycled[0], w.number, w.seq)
+		w.recycled = w.recycled[1:]
+	} else {
+		w.f = createSegment(w.dir, w.number, w.seq)
+	}
+	w.segments = append(w.segments, w.number)
+	w.offset = headerSize
+}
+
+// progressInterval 是回放时上报进度的记录间隔
+const progressInterval = 1 << 16
+
+// replayer 记录 Wal 的回放状态
+type replayer struct {
+	t       memTable.MemTable                            // 正在恢复的 MemTable
+	flush   func(memTable.MemTable, uint64, uint64, int) // 将回放出的 MemTable 写入 0 层
+	remove  func(number int)                             // 删除编号小于 number 的段
+	full    bool                                         // MemTable 已达到落盘的阈值
+	flushed bool                                         // 回放期间是否落盘过
+	seq     uint64                                       // 已回放的最后一条记录的序列号
+	first   uint64                                       // MemTable 中第一条记录的序列号, 没有记录时为 0
+	records int                                          // 已回放的记录数
+	bytes   int64                                        // 已回放的字节数
+	pending int64                                        // 上次落盘后回放的字节数
+	start   time.Time
+}
+
+// segmentInfo 是一个段的回放结果
+type segmentInfo struct {
+	version uint32 // 段的版本
+	records int    // 完整记录的数量
+}
+
+// 逐条解码一个段中的记录并回放到 MemTable 中, 直到日志的逻辑末尾
+// 末尾不完整的记录 (写入时崩溃) 会被忽略, 之后的写入不会再追加到这个段中
+func (r *replayer) replaySegment(segPath string, number int) (info segmentInfo) {
+	f, err := os.Open(segPath)
+	if err != nil {
+		log.Panicln("fail to open the wal segment:", segPath, err)
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		log.Panicln("fail to stat the wal segment:", segPath, err)
+	}
+	reader := bufio.NewReaderSize(f, 1<<20)
+	size := int64(0) // 段头和完整记录的字节数
+	header, ok := readHeader(reader)
+	if ok {
+		size = headerSize
+	}
+	d := newDecoder(header, number, r.seq)
+	info.version = d.version
+
+	for {
+		record, n, err := d.decode(reader, stat.Size()-size)
+		if err == io.EOF {
+			break
+		}
+		if err == io.ErrUnexpectedEOF {
+			log.Printf("the wal segment %s has an incomplete record at %d, ignoring it\n", segPath, size)
+			break
 		}
-		// 将元素的所有字节读取出来，并还原为 kv.Data
-		index += 8
-		var value kv.Data
-		dataArea := data[index : index+dataLen]
-		if err = json.Unmarshal(dataArea, &value); err != nil {
-			log.Panicln("fail to unmarshal the data:", err)
+		if err != nil {
+			log.Panicln("fail to read the wal segment:", segPath, err)
+		}
+		// 段中还有记录, 这个段在落盘后仍需回放
+		r.flushBefore(number)
+		r.seq = record.Seq
+		if r.first == 0 {
+			r.first = record.Seq
 		}
-		if value.Deleted {
-			t.Delete(value.Key)
+		if record.Deleted {
+			r.t.Delete(record.Key)
 		} else {
-			t.Set(value.Key, value.Value)
+			r.t.Set(record.Key, record.Value)
 		}
-		index += dataLen
+		size += n
+		info.records++
+		r.apply(n)
+	}
+	if d.seq > r.seq {
+		r.seq = d.seq
+	}
+	// 段中的记录都已回放, 落盘后不再需要这个段
+	r.flushBefore(number + 1)
+	return info
+}
+
+// 统计一条已回放的记录, 必要时上报进度, MemTable 达到阈值时在回放下一条记录或段结束时落盘
+func (r *replayer) apply(n int64) {
+	r.records++
+	r.bytes += n
+	r.pending += n
+	if r.records%progressInterval == 0 {
+		r.report()
 	}
-	return t
+	cfg := config.GetConfig()
+	memSize := r.t.GetSize()
+	r.full = r.t.GetCount() >= cfg.Threshold || int(r.pending>>20) >= cfg.Level0Size || (cfg.MemTableSizeBytes > 0 && memSize >= cfg.MemTableSizeBytes)
 }
 
-// Write 将数组增加、修改和删除操作写入Wal
-func (w *Wal) Write(value kv.Data) {
+// MemTable 达到阈值时将其落盘, 之后删除编号小于 number 的段, 其中的数据都已包含在这次及之前落盘的 MemTable 中
+func (r *replayer) flushBefore(number int) {
+	if !r.full || r.flush == nil {
+		return
+	}
+	log.Printf("replayed MemTable has %d Nodes, %d bytes, Wal %d MB, flushing it\n", r.t.GetCount(), r.t.GetSize(), r.pending>>20)
+	r.flush(r.t, r.first, r.seq, number)
+	r.t.Reset()
+	r.pending = 0
+	r.first = 0
+	r.full = false
+	r.flushed = true
+	r.remove(number)
+}
+
+// 上报回放进度
+func (r *replayer) report() {
+	if progress := config.GetConfig().ReplayProgress; progress != nil {
+		progress(r.records, r.bytes, time.Since(r.start))
+	}
+}
+
+// Write 将数组增加、修改和删除操作写入Wal, 返回分配给这条记录的序列号
+func (w *Wal) Write(value kv.Data) uint64 {
+	w.Lock()
+	defer w.Unlock()
+	w.append(Record{Seq: w.seq + 1, Time: time.Now().UnixNano(), Data: value})
+	return w.seq
+}
+
+// WriteRecord 按原有的序列号写入一条记录, 用于从其他数据库复制过来的记录
+func (w *Wal) WriteRecord(record Record) {
+	w.Lock()
+	defer w.Unlock()
+	w.append(record)
+}
+
+// Reserve 跳过 n 个序列号并返回其中的第一个, 用于导入的 SsTable 等不经过 Wal 的数据
+// 之后的记录写入一个新的段, 段头中的序列号保证重启后不会再分配被跳过的序列号
+func (w *Wal) Reserve(n int) uint64 {
+	w.Lock()
+	defer w.Unlock()
+	if err := w.f.Sync(); err != nil {
+		log.Panicln("fail to sync the wal segment:", err)
+	}
+	if err := w.f.Close(); err != nil {
+		log.Panicln("fail to close the wal segment:", err)
+	}
+	first := w.seq + 1
+	w.seq += uint64(n)
+	w.newSegment()
+	w.cond.Broadcast()
+	return first
+}
+
+// Sync 将当前段落盘
+func (w *Wal) Sync() {
 	w.Lock()
 	defer w.Unlock()
-	data, _ := json.Marshal(value)
-	if err := binary.Write(w.f, binary.LittleEndian, int64(len(data))); err != nil {
-		log.Panicln("fail to write the wal.log: " + err.Error())
+	if err := w.f.Sync(); err != nil {
+		log.Panicln("fail to sync the wal segment:", err)
+	}
+}
+
+// LastSeq 获取最后一条记录的序列号
+func (w *Wal) LastSeq() uint64 {
+	w.Lock()
+	defer w.Unlock()
+	return w.seq
+}
+
+// 追加一条记录并通知 Reader, 调用者需持有锁
+func (w *Wal) append(record Record) {
+	data := encodeRecord(record, w.number)
+	if _, err := w.f.WriteAt(data, w.offset); err != nil {
+		log.Panicln("fail to write the wal segment: " + err.Error())
 	}
-	//if _, err := w.f.Write(data); err != nil {
-	//	log.Panicln("fail to write the wal.log: " + err.Error())
-	//}
-	if err := binary.Write(w.f, binary.LittleEndian, data); err != nil {
-		log.Panicln("fail to write the wal.log: " + err.Error())
+	w.seq = record.Seq
+	if w.memSeq == 0 {
+		w.memSeq = record.Seq
 	}
+	w.offset += int64(len(data))
+	w.size += int64(len(data))
+	w.cond.Broadcast()
 }
 
-func (w *Wal) Reset() {
+// Rotate 将当前段落盘并开启一个新的段, 返回新段的编号, 以及被封存的 MemTable 中第一条和最后一条记录的序列号
+// 编号小于返回的 number 的段中的数据都属于被封存的 MemTable, MemTable 为空时 first 为 0
+func (w *Wal) Rotate() (number int, first uint64, last uint64) {
 	w.Lock()
 	defer w.Unlock()
+	if err := w.f.Sync(); err != nil {
+		log.Panicln("fail to sync the wal segment:", err)
+	}
 	if err := w.f.Close(); err != nil {
-		log.Panicln(err)
+		log.Panicln("fail to close the wal segment:", err)
 	}
-	if err := os.Remove(w.f.Name()); err != nil {
-		log.Panicln(err)
+	first, last = w.memSeq, w.seq
+	if first == 0 {
+		last = 0
 	}
-	time.Sleep(time.Millisecond)
-	f, err := os.OpenFile(w.path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
-	if err != nil {
-		log.Panicln(err)
+	w.newSegment()
+	w.size = 0
+	w.memSeq = 0
+	w.cond.Broadcast()
+	return w.number, first, last
+}
+
+// Remove 删除 (或归档) 编号小于 number 的段, 只能在对应的 SsTable 落盘并加入 TablesTree 后调用
+// 仍被 Reader 使用的段会被保留下来, 但启动时不再回放
+func (w *Wal) Remove(number int) {
+	w.Lock()
+	defer w.Unlock()
+	w.remove(number)
+}
+
+// 删除编号小于 number 的段, 调用者需持有锁
+func (w *Wal) remove(number int) {
+	pinned := w.minPinned()
+	i := 0
+	for ; i < len(w.segments) && w.segments[i] < number; i++ {
+		segment := w.segments[i]
+		if segment < pinned {
+			w.discard(segmentPath(w.dir, segment), segment)
+			continue
+		}
+		if err := os.Rename(segmentPath(w.dir, segment), flushedPath(w.dir, segment)); err != nil {
+			log.Panicln("fail to rename the wal segment:", err)
+		}
+		w.flushed = append(w.flushed, segment)
+	}
+	w.segments = w.segments[i:]
+	w.release()
+}
+
+// 删除不再被 Reader 使用的已落盘段, 调用者需持有锁
+func (w *Wal) release() {
+	pinned := w.minPinned()
+	i := 0
+	for ; i < len(w.flushed) && w.flushed[i] < pinned; i++ {
+		w.discard(flushedPath(w.dir, w.flushed[i]), w.flushed[i])
+	}
+	w.flushed = w.flushed[i:]
+	syncDir(w.dir)
+}
+
+// 获取 Reader 正在使用的最小段编号, 调用者需持有锁
+func (w *Wal) minPinned() int {
+	pinned := math.MaxInt
+	for r := range w.readers {
+		if r.number < pinned {
+			pinned = r.number
+		}
+	}
+	return pinned
+}
+
+// 获取有序编号中最大的一个, 为空时返回 -1
+func lastNumber(numbers []int) int {
+	if len(numbers) == 0 {
+		return -1
 	}
-	w.f = f
+	return numbers[len(numbers)-1]
 }
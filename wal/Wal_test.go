@@ -0,0 +1,152 @@
+package wal
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"qlsm/config"
+	"qlsm/kv"
+	"qlsm/memTable"
+	"qlsm/memTable/skiplist"
+	"testing"
+)
+
+// 预分配 1MB 的段, 保留一个旧段用于复用, 回放出 20 个元素时落盘
+func TestMain(m *testing.M) {
+	config.Init(config.Config{
+		Threshold:       20,
+		Level0Size:      1 << 10,
+		WalPreallocSize: 1,
+		WalRecycleCount: 1,
+		MemTableFactory: func() memTable.MemTable { return skiplist.New() },
+	})
+	os.Exit(m.Run())
+}
+
+func writeRecords(w *Wal, prefix string, n int) {
+	for i := 0; i < n; i++ {
+		w.Write(kv.Data{Key: fmt.Sprintf("%s%03d", prefix, i), Value: []byte(`"value"`)})
+	}
+}
+
+// 段 N 被复用为段 M 后写入更少的记录, 回放段 M 时在逻辑末尾停止, 不会回放残留的旧记录
+func TestReplayRecycledSegment(t *testing.T) {
+	dir := t.TempDir()
+	w := &Wal{}
+	w.Load(dir, 0, 0, nil)
+	// 段 1 写满 50 条记录, 落盘后等待复用
+	writeRecords(w, "a", 50)
+	number, _, _ := w.Rotate()
+	w.Remove(number)
+	if len(w.recycled) != 1 || w.recycled[0] != 1 {
+		t.Fatalf("recycled segments %v, want [1]", w.recycled)
+	}
+	// 段 2 封存时复用段 1 的文件作为段 3
+	writeRecords(w, "b", 10)
+	w.Rotate()
+	if _, err := os.Stat(recyclePath(dir, 1)); !os.IsNotExist(err) {
+		t.Fatalf("the recycled file is not reused: %v", err)
+	}
+	// 与旧记录长度相同, 新记录之后紧接着一条完整的旧记录
+	writeRecords(w, "a", 5)
+	lastSeq := w.LastSeq()
+	// 序列号恰好连续的旧记录只能通过段编号识别
+	stale := encodeRecord(Record{Seq: lastSeq + 1, Data: kv.Data{Key: "a999", Value: []byte(`"value"`)}}, 1)
+	if _, err := w.f.WriteAt(stale, w.offset); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(segmentPath(dir, 3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(data, []byte(`"a049"`)) {
+		t.Fatal("the recycled segment should still hold the stale records")
+	}
+
+	w = &Wal{}
+	mt := w.Load(dir, 0, 0, nil)
+	defer w.f.Close()
+	if mt.GetCount() != 15 {
+		t.Fatalf("replayed %d records, want 15", mt.GetCount())
+	}
+	for _, v := range mt.GetValues() {
+		if v.Key >= "a005" && v.Key < "b" {
+			t.Fatalf("replayed the stale record %s", v.Key)
+		}
+	}
+	if w.LastSeq() != lastSeq {
+		t.Fatalf("LastSeq() = %d, want %d", w.LastSeq(), lastSeq)
+	}
+	// 重启后写入的记录与之前的记录一起回放
+	writeRecords(w, "c", 3)
+	if err = w.f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	w = &Wal{}
+	mt = w.Load(dir, 0, 0, nil)
+	defer w.f.Close()
+	if mt.GetCount() != 18 || w.LastSeq() != lastSeq+3 {
+		t.Fatalf("replayed %d records up to %d, want 18 up to %d", mt.GetCount(), w.LastSeq(), lastSeq+3)
+	}
+}
+
+type replayFlush struct {
+	count       int
+	first, last uint64
+	number      int
+}
+
+// 回放时落盘后删除数据都已落盘的段, 段中还有未回放的记录时保留这个段, 并记录这个段的编号
+func TestReplayFlushSegments(t *testing.T) {
+	cases := []struct {
+		records  []int         // 每个段中的记录数
+		reuse    bool          // 最新的段为空, 启动后被复用
+		flushes  []replayFlush // 每次落盘的 MemTable
+		segments []int         // 回放后保留的段
+	}{
+		// 段 1 回放到一半时落盘, 剩余的数据在最后一起落盘, 只保留复用的空段
+		{[]int{30, 5}, true, []replayFlush{{20, 1, 20, 1}, {15, 21, 35, 3}}, []int{3}},
+		// 段 1 结束时恰好达到阈值
+		{[]int{20, 5}, false, []replayFlush{{20, 1, 20, 2}, {5, 21, 25, 3}}, []int{3}},
+		// 没有达到阈值时不落盘
+		{[]int{10, 5}, false, nil, []int{1, 2, 3}},
+	}
+	for _, c := range cases {
+		dir := t.TempDir()
+		w := &Wal{}
+		w.Load(dir, 0, 0, nil)
+		for i, n := range c.records {
+			if i > 0 {
+				w.Rotate()
+			}
+			writeRecords(w, string(rune('a'+i)), n)
+		}
+		if c.reuse {
+			w.Rotate()
+		}
+		if err := w.f.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		var flushes []replayFlush
+		w = &Wal{}
+		mt := w.Load(dir, 0, 0, func(mt memTable.MemTable, first uint64, last uint64, number int) {
+			flushes = append(flushes, replayFlush{mt.GetCount(), first, last, number})
+		})
+		_ = w.f.Close()
+		if fmt.Sprint(flushes) != fmt.Sprint(c.flushes) {
+			t.Fatalf("segments %v: flushed %v, want %v", c.records, flushes, c.flushes)
+		}
+		// 落盘过时 MemTable 中不再有数据, 之前的段都已删除或等待复用
+		if c.flushes != nil && mt.GetCount() != 0 {
+			t.Fatalf("segments %v: %d records left", c.records, mt.GetCount())
+		}
+		if segments := listSegments(dir, ""); fmt.Sprint(segments) != fmt.Sprint(c.segments) {
+			t.Fatalf("segments %v: %v left, want %v", c.records, segments, c.segments)
+		}
+	}
+}
@@ -0,0 +1,216 @@
+package wal
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"qlsm/config"
+)
+
+// errStopReplay 用于在回放归档时提前结束
+var errStopReplay = errors.New("stop replaying")
+
+// 删除一个不再需要的段, 配置了归档目录时将其移动到归档目录中, 否则可能保留下来等待复用, 调用者需持有锁
+func (w *Wal) discard(segPath string, number int) {
+	cfg := config.GetConfig()
+	archiveDir := cfg.WalArchiveDir
+	if archiveDir == "" {
+		// 保留一部分旧文件用于复用, 省去新建文件和分配空间的开销
+		if len(w.recycled) < cfg.WalRecycleCount {
+			if err := os.Rename(segPath, recyclePath(w.dir, number)); err != nil {
+				log.Panicln("fail to rename the wal segment:", err)
+			}
+			w.recycled = append(w.recycled, number)
+			return
+		}
+		if err := os.Remove(segPath); err != nil {
+			log.Panicln("fail to delete the wal segment:", err)
+		}
+		return
+	}
+	if err := os.MkdirAll(archiveDir, 0755); err != nil {
+		log.Panicln("fail to create the wal archive directory:", err)
+	}
+	archivePath := segmentPath(archiveDir, number)
+	// 归档目录位于其他文件系统时无法重命名, 改为复制后删除
+	if err := os.Rename(segPath, archivePath); err != nil {
+		if err = copyFile(segPath, archivePath); err != nil {
+			log.Panicln("fail to archive the wal segment:", err)
+		}
+		if err = os.Remove(segPath); err != nil {
+			log.Panicln("fail to delete the wal segment:", err)
+		}
+	}
+	syncDir(archiveDir)
+}
+
+// Backup 将启动时需要回放的段复制到 dir 中, 与同一时刻的 SsTable 一起构成一份完整的备份
+// 调用期间不能有新的写入, 否则备份中的段可能只包含部分记录
+func (w *Wal) Backup(dir string) error {
+	w.Lock()
+	defer w.Unlock()
+	if err := w.f.Sync(); err != nil {
+		return err
+	}
+	for _, number := range w.segments {
+		if err := copyFile(segmentPath(w.dir, number), segmentPath(dir, number)); err != nil {
+			return err
+		}
+	}
+	syncDir(dir)
+	return nil
+}
+
+// Restore 将 dir 中的备份恢复到之后的某个时刻
+// 按序列号顺序回放 archiveDir 中归档的记录, 追加到 dir 中的新段里, 直到 stop 返回 true
+// 导入 SsTable 时跳过的序列号没有记录, 导入的数据不会被恢复, 之后的记录写入一个以跳过后的序列号开头的新段
+// 之后以 dir 作为数据目录启动数据库即可得到恢复后的数据, 返回回放的记录数
+func Restore(dir string, archiveDir string, stop func(Record) bool) (int, error) {
+	// 备份中最后一条记录的序列号
+	var lastSeq uint64
+	segments := listSegments(dir, "")
+	for _, number := range segments {
+		header, err := scanSegment(segmentPath(dir, number), number, func(record Record) error {
+			if record.Seq > lastSeq {
+				lastSeq = record.Seq
+			}
+			if stop(record) {
+				return fmt.Errorf("the backup is newer than the restore target: record %d", record.Seq)
+			}
+			return nil
+		})
+		if err != nil {
+			return 0, err
+		}
+		if header.BaseSeq > lastSeq {
+			lastSeq = header.BaseSeq
+		}
+	}
+
+	number := lastNumber(segments) + 1
+	f := createSegment(dir, number, lastSeq)
+	defer func() { _ = f.Close() }()
+	offset := int64(headerSize)
+	count := 0
+	// 已读取的归档段, 备份中的段可能不完整, 只有紧跟在完整的段之后才能跳过序列号, 否则是归档中缺少了段
+	archivedSet := map[int]bool{}
+	for _, archived := range listSegments(archiveDir, "") {
+		archivePath := segmentPath(archiveDir, archived)
+		header, err := readSegmentHeader(archivePath)
+		if err != nil {
+			return count, err
+		}
+		// 段头中的序列号之前的记录都在之前的段中, 大于 lastSeq 时中间的序列号被导入跳过
+		reserved := archivedSet[archived-1] && header.BaseSeq > lastSeq
+		archivedSet[archived] = true
+		_, err = scanSegment(archivePath, archived, func(record Record) error {
+			if record.Seq <= lastSeq {
+				return nil
+			}
+			skipped := record.Seq != lastSeq+1
+			if skipped && (!reserved || record.Seq != header.BaseSeq+1) {
+				return fmt.Errorf("the archive is missing records between sequence %d and %d", lastSeq, record.Seq)
+			}
+			if stop(record) {
+				return errStopReplay
+			}
+			// 回放时要求同一个段中的序列号连续, 跳过的序列号之后开启新的段
+			if skipped {
+				if err := f.Sync(); err != nil {
+					return err
+				}
+				_ = f.Close()
+				number++
+				f = createSegment(dir, number, header.BaseSeq)
+				offset = headerSize
+			}
+			data := encodeRecord(record, number)
+			if _, err := f.WriteAt(data, offset); err != nil {
+				return err
+			}
+			offset += int64(len(data))
+			lastSeq = record.Seq
+			count++
+			return nil
+		})
+		if err == errStopReplay {
+			break
+		}
+		if err != nil {
+			return count, err
+		}
+	}
+	if err := f.Sync(); err != nil {
+		return count, err
+	}
+	return count, nil
+}
+
+// 读取段头, 旧版本的段没有段头, 返回零值
+func readSegmentHeader(segPath string) (segmentHeader, error) {
+	f, err := os.Open(segPath)
+	if err != nil {
+		return segmentHeader{}, err
+	}
+	defer f.Close()
+	header, _ := readHeader(bufio.NewReaderSize(f, headerSize))
+	return header, nil
+}
+
+// 按顺序读取 number 号段中的所有完整记录, 旧版本的段没有序列号, 会被跳过
+func scanSegment(segPath string, number int, fn func(Record) error) (segmentHeader, error) {
+	f, err := os.Open(segPath)
+	if err != nil {
+		return segmentHeader{}, err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return segmentHeader{}, err
+	}
+	reader := bufio.NewReaderSize(f, 1<<20)
+	header, ok := readHeader(reader)
+	if !ok {
+		return header, nil
+	}
+	d := newDecoder(header, number, 0)
+	size := int64(headerSize)
+	for {
+		record, n, err := d.decode(reader, stat.Size()-size)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return header, nil
+		}
+		if err != nil {
+			return header, fmt.Errorf("%s: %w", segPath, err)
+		}
+		if err = fn(record); err != nil {
+			return header, err
+		}
+		size += n
+	}
+}
+
+// 将 src 复制到 dst 并落盘
+func copyFile(src string, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, in); err != nil {
+		_ = out.Close()
+		return err
+	}
+	if err = out.Sync(); err != nil {
+		_ = out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,67 @@
+package wal
+
+import (
+	"strings"
+	"testing"
+)
+
+// 导入 SsTable 时跳过了序列号, 恢复时从段头中跳过后的序列号继续回放, 不会被当作归档缺少记录
+func TestRestoreAfterReserve(t *testing.T) {
+	dir, backup := t.TempDir(), t.TempDir()
+	w := &Wal{}
+	w.Load(dir, 0, 0, nil)
+	writeRecords(w, "a", 5)
+	if err := w.Backup(backup); err != nil {
+		t.Fatal(err)
+	}
+	writeRecords(w, "b", 3)
+	if first := w.Reserve(2); first != 9 {
+		t.Fatalf("Reserve(2) = %d, want 9", first)
+	}
+	writeRecords(w, "c", 4)
+	if err := w.f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 仍在数据目录中的段与归档的段相同
+	cases := []struct {
+		target  uint64
+		count   int    // 回放的记录数
+		keys    int    // 恢复后的元素数
+		lastSeq uint64 // 恢复后最后一条记录的序列号
+	}{
+		{14, 7, 12, 14},
+		{12, 5, 10, 12},
+		// 目标位于跳过的序列号中
+		{9, 3, 8, 8},
+	}
+	for _, c := range cases {
+		restored := t.TempDir()
+		if err := copyFile(segmentPath(backup, 1), segmentPath(restored, 1)); err != nil {
+			t.Fatal(err)
+		}
+		n, err := Restore(restored, dir, func(r Record) bool { return r.Seq > c.target })
+		if err != nil || n != c.count {
+			t.Fatalf("restoring to %d replayed %d records, err %v, want %d", c.target, n, err, c.count)
+		}
+		r := &Wal{}
+		mt := r.Load(restored, 0, 0, nil)
+		_ = r.f.Close()
+		if mt.GetCount() != c.keys || r.LastSeq() != c.lastSeq {
+			t.Fatalf("restored to %d: %d keys up to %d, want %d up to %d", c.target, mt.GetCount(), r.LastSeq(), c.keys, c.lastSeq)
+		}
+	}
+
+	// 归档中缺少导入前的段时, 不能把缺少的记录当作跳过的序列号
+	archive, restored := t.TempDir(), t.TempDir()
+	if err := copyFile(segmentPath(dir, 2), segmentPath(archive, 2)); err != nil {
+		t.Fatal(err)
+	}
+	if err := copyFile(segmentPath(backup, 1), segmentPath(restored, 1)); err != nil {
+		t.Fatal(err)
+	}
+	_, err := Restore(restored, archive, func(Record) bool { return false })
+	if err == nil || !strings.Contains(err.Error(), "missing records") {
+		t.Fatalf("restoring without the segment before the ingest returned %v", err)
+	}
+}
@@ -0,0 +1,18 @@
+//go:build linux
+
+package wal
+
+import (
+	"os"
+	"syscall"
+)
+
+// 使用 fallocate 为段文件预分配 size 字节的磁盘空间, 追加写入时无需再更新文件元数据
+func preallocate(f *os.File, size int64) error {
+	err := syscall.Fallocate(int(f.Fd()), 0, 0, size)
+	// 文件系统不支持 fallocate 时退化为扩展文件大小
+	if err == syscall.EOPNOTSUPP {
+		return f.Truncate(size)
+	}
+	return err
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package wal
+
+import "os"
+
+// 不支持 fallocate 的平台上只扩展文件大小
+func preallocate(f *os.File, size int64) error {
+	return f.Truncate(size)
+}
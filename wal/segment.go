@@ -0,0 +1,286 @@
+package wal
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path"
+	"qlsm/config"
+	"qlsm/kv"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/*
+段文件的格式, 旧版本的段没有段头, 直接从记录开始
+┌───────────────────────────────────┬──────────┬──────────┬─────┬──────────────┐
+│           SegmentHeader           │  Record  │  Record  │ ... │ 预分配的空间 │
+│ magic(4) | version(4) | baseSeq(8) │          │          │     │              │
+└───────────────────────────────────┴──────────┴──────────┴─────┴──────────────┘
+版本 1 的记录为 dataLen(8) | json(Record)
+版本 2 的记录为 crc(4) | dataLen(4) | number(8) | json(Record), crc 覆盖 crc 之后的所有字节
+段文件可能是预分配或复用的, 文件大小不等于日志的逻辑末尾, 遇到以下情况即认为到达逻辑末尾:
+全零的预分配空间、段编号不符的旧记录 (来自被复用的文件)、序列号不连续的记录
+*/
+
+const (
+	segmentMagic      uint32 = 0x4C415751 // "QWAL"
+	segmentVersion    uint32 = 2
+	headerSize               = 16
+	recordHeaderSize         = 16
+	legacyVersion     uint32 = 0 // 没有段头的旧版本
+	lengthOnlyVersion uint32 = 1 // 记录只有长度前缀的版本
+)
+
+const (
+	flushedSuffix = ".flushed" // 已落盘但仍被 Reader 使用的段的后缀, 启动时不会被回放
+	recycleSuffix = ".recycle" // 等待复用的旧段文件的后缀
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// Record 是 Wal 中的一条记录
+type Record struct {
+	Seq  uint64 // 序列号, 在整个数据库中连续递增
+	Time int64  // 写入主库的时间 (UnixNano)
+	kv.Data
+}
+
+// segmentHeader 位于每个段的开头
+type segmentHeader struct {
+	Magic   uint32
+	Version uint32
+	BaseSeq uint64 // 段中第一条记录之前的序列号
+}
+
+// 获取段文件的路径
+func segmentPath(dir string, number int) string {
+	return path.Join(dir, fmt.Sprintf("%06d.wal", number))
+}
+
+// 获取已落盘段文件的路径
+func flushedPath(dir string, number int) string {
+	return segmentPath(dir, number) + flushedSuffix
+}
+
+// 获取等待复用的段文件的路径
+func recyclePath(dir string, number int) string {
+	return segmentPath(dir, number) + recycleSuffix
+}
+
+// 获取目录中所有以 suffix 结尾的段的编号, 按编号递增排列
+func listSegments(dir string, suffix string) []int {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		log.Panicln("fail to read the wal directory:", err)
+	}
+	var numbers []int
+	for _, f := range files {
+		name, ok := strings.CutSuffix(f.Name(), suffix)
+		if !ok {
+			continue
+		}
+		name, ok = strings.CutSuffix(name, ".wal")
+		if !ok {
+			continue
+		}
+		if number, err := strconv.Atoi(name); err == nil {
+			numbers = append(numbers, number)
+		}
+	}
+	sort.Ints(numbers)
+	return numbers
+}
+
+// 创建一个新的段文件, 按配置预分配空间并写入段头, 并确保目录项落盘
+func createSegment(dir string, number int, baseSeq uint64) *os.File {
+	f, err := os.OpenFile(segmentPath(dir, number), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		log.Panicln("fail to create the wal segment:", err)
+	}
+	if size := int64(config.GetConfig().WalPreallocSize) << 20; size > 0 {
+		if err = preallocate(f, size); err != nil {
+			log.Panicln("fail to preallocate the wal segment:", err)
+		}
+	}
+	writeHeader(f, baseSeq)
+	syncDir(dir)
+	return f
+}
+
+// 将等待复用的段文件重命名为新的段并覆盖段头, 文件中残留的旧记录会因段编号不符而被忽略
+func recycleSegment(dir string, recycled int, number int, baseSeq uint64) *os.File {
+	if err := os.Rename(recyclePath(dir, recycled), segmentPath(dir, number)); err != nil {
+		log.Panicln("fail to recycle the wal segment:", err)
+	}
+	f, err := os.OpenFile(segmentPath(dir, number), os.O_RDWR, 0666)
+	if err != nil {
+		log.Panicln("fail to open the wal segment:", err)
+	}
+	writeHeader(f, baseSeq)
+	syncDir(dir)
+	return f
+}
+
+// 写入段头并落盘
+func writeHeader(f *os.File, baseSeq uint64) {
+	bs := make([]byte, headerSize)
+	binary.LittleEndian.PutUint32(bs[0:], segmentMagic)
+	binary.LittleEndian.PutUint32(bs[4:], segmentVersion)
+	binary.LittleEndian.PutUint64(bs[8:], baseSeq)
+	if _, err := f.WriteAt(bs, 0); err != nil {
+		log.Panicln("fail to write the wal segment header:", err)
+	}
+	if err := f.Sync(); err != nil {
+		log.Panicln("fail to sync the wal segment:", err)
+	}
+}
+
+// 读取段头, 旧版本的段没有段头时返回 false 且不消耗任何字节
+func readHeader(r *bufio.Reader) (segmentHeader, bool) {
+	var header segmentHeader
+	bs, err := r.Peek(headerSize)
+	if err != nil || binary.LittleEndian.Uint32(bs) != segmentMagic {
+		return header, false
+	}
+	_ = binary.Read(r, binary.LittleEndian, &header)
+	return header, true
+}
+
+// 编码一条写入 number 号段的记录
+func encodeRecord(record Record, number int) []byte {
+	data, err := json.Marshal(record)
+	if err != nil {
+		log.Panicln("fail to marshal the wal record:", err)
+	}
+	bs := make([]byte, recordHeaderSize, recordHeaderSize+len(data))
+	binary.LittleEndian.PutUint32(bs[4:], uint32(len(data)))
+	binary.LittleEndian.PutUint64(bs[8:], uint64(number))
+	bs = append(bs, data...)
+	binary.LittleEndian.PutUint32(bs[0:], crc32.Checksum(bs[4:], crcTable))
+	return bs
+}
+
+// decoder 按段的版本逐条解码记录
+type decoder struct {
+	version uint32 // 段的版本
+	number  int    // 段编号, 用于识别复用文件中的旧记录
+	seq     uint64 // 上一条记录的序列号
+	buf     []byte
+}
+
+// 创建一个解码 number 号段的 decoder, 没有段头时 header 为零值
+func newDecoder(header segmentHeader, number int, seq uint64) *decoder {
+	d := &decoder{version: header.Version, number: number, seq: seq}
+	if header.Magic != segmentMagic {
+		d.version = legacyVersion
+	}
+	if header.BaseSeq > d.seq {
+		d.seq = header.BaseSeq
+	}
+	return d
+}
+
+// 从 r 中解码一条记录, 返回记录占用的字节数, remain 为 r 中剩余的字节数
+// 到达日志的逻辑末尾时返回 io.EOF, 末尾的记录不完整 (写入时崩溃或正在写入) 时返回 io.ErrUnexpectedEOF
+func (d *decoder) decode(r io.Reader, remain int64) (record Record, n int64, err error) {
+	if d.version < segmentVersion {
+		record, n, err = d.decodeLengthOnly(r, remain)
+	} else {
+		record, n, err = d.decodeChecked(r, remain)
+	}
+	if err != nil {
+		return record, 0, err
+	}
+	// 旧版本的记录没有序列号, 按顺序补齐
+	if record.Seq == 0 && d.version == legacyVersion {
+		record.Seq = d.seq + 1
+	}
+	if record.Seq != d.seq+1 && d.version >= segmentVersion {
+		return Record{}, 0, io.EOF
+	}
+	d.seq = record.Seq
+	return record, n, nil
+}
+
+// 解码只有长度前缀的记录
+func (d *decoder) decodeLengthOnly(r io.Reader, remain int64) (record Record, n int64, err error) {
+	// 获取元素的字节长度
+	var dataLen int64
+	if err = binary.Read(r, binary.LittleEndian, &dataLen); err != nil {
+		return record, 0, err
+	}
+	// 长度超出剩余范围说明记录没有写完整
+	if dataLen < 0 || 8+dataLen > remain {
+		return record, 0, io.ErrUnexpectedEOF
+	}
+	// 将元素的所有字节读取出来，并还原为 Record
+	data, err := d.read(r, int(dataLen))
+	if err != nil {
+		return record, 0, err
+	}
+	if err = json.Unmarshal(data, &record); err != nil {
+		return record, 0, fmt.Errorf("fail to unmarshal the wal record: %w", err)
+	}
+	return record, 8 + dataLen, nil
+}
+
+// 解码带校验和与段编号的记录
+func (d *decoder) decodeChecked(r io.Reader, remain int64) (record Record, n int64, err error) {
+	header, err := d.read(r, recordHeaderSize)
+	if err != nil {
+		return record, 0, err
+	}
+	checksum := binary.LittleEndian.Uint32(header[0:])
+	dataLen := int64(binary.LittleEndian.Uint32(header[4:]))
+	number := binary.LittleEndian.Uint64(header[8:])
+	// 预分配的空白或复用文件中的旧记录
+	if dataLen == 0 || number != uint64(d.number) {
+		return record, 0, io.EOF
+	}
+	if recordHeaderSize+dataLen > remain {
+		return record, 0, io.ErrUnexpectedEOF
+	}
+	crc := crc32.Update(0, crcTable, header[4:])
+	data, err := d.read(r, int(dataLen))
+	if err != nil {
+		return record, 0, err
+	}
+	if crc32.Update(crc, crcTable, data) != checksum {
+		return record, 0, io.ErrUnexpectedEOF
+	}
+	if err = json.Unmarshal(data, &record); err != nil {
+		return record, 0, fmt.Errorf("fail to unmarshal the wal record: %w", err)
+	}
+	return record, recordHeaderSize + dataLen, nil
+}
+
+// 从 r 中读取 n 个字节到复用的缓冲区中
+func (d *decoder) read(r io.Reader, n int) ([]byte, error) {
+	if cap(d.buf) < n {
+		d.buf = make([]byte, n)
+	}
+	data := d.buf[:n]
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// 将目录落盘, 保证文件的创建和删除持久化
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		log.Panicln("fail to open the directory:", err)
+	}
+	defer d.Close()
+	if err = d.Sync(); err != nil {
+		log.Panicln("fail to sync the directory:", err)
+	}
+}